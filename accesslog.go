@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const MaxAccessLogEntries = 1000
+
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+// AccessLogConfig configures where and how the proxy logs requests.
+type AccessLogConfig struct {
+	// Format is either AccessLogCombined or AccessLogJSON.
+	Format string
+
+	// Path is the file to which log entries are appended. If it is "-", entries are written to
+	// standard output. If it is empty, entries are only kept in memory for the control panel.
+	Path string
+
+	// MaxSize is the number of megabytes a log file may reach before it is rotated.
+	// If it is 0, files are never rotated.
+	MaxSize int
+
+	// MaxFiles is the number of rotated files to keep alongside each log file.
+	MaxFiles int
+}
+
+// Validate returns an error if the configuration is invalid.
+func (a *AccessLogConfig) Validate() error {
+	switch a.Format {
+	case "", AccessLogCombined, AccessLogJSON:
+	default:
+		return errors.New("invalid access log format: " + a.Format)
+	}
+	if a.MaxSize < 0 || a.MaxFiles < 0 {
+		return errors.New("access log limits must not be negative")
+	}
+	return nil
+}
+
+// An AccessLogEntry records a single proxied request.
+type AccessLogEntry struct {
+	// Time is the UNIX timestamp in milliseconds when the request was received.
+	Time int64
+
+	RequestID  string
+	ClientIP   string
+	Method     string
+	Host       string
+	Path       string
+	Proto      string
+	Status     int
+	Bytes      int64
+	Referer    string
+	UserAgent  string
+	TLSVersion string
+
+	// Upstream is the target which handled the request, or "" if none did.
+	Upstream string
+
+	// Latency is the number of milliseconds it took to handle the request.
+	Latency float64
+}
+
+// Combined formats the entry in the combined log format, followed by the host, upstream,
+// latency, and TLS version.
+func (a *AccessLogEntry) Combined() string {
+	t := time.Unix(0, a.Time*1000000).Format("02/Jan/2006:15:04:05 -0700")
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d %s %s %s %s %.3f %s",
+		a.ClientIP, t, a.Method, a.Path, a.Proto, a.Status, a.Bytes,
+		strconv.Quote(a.Referer), strconv.Quote(a.UserAgent), strconv.Quote(a.Host),
+		strconv.Quote(a.Upstream), a.Latency, strconv.Quote(a.TLSVersion))
+}
+
+// An AccessLogger writes AccessLogEntries to log files and keeps the most recent entries in
+// memory.
+type AccessLogger struct {
+	lock      sync.Mutex
+	config    AccessLogConfig
+	files     map[string]io.WriteCloser
+	recent    []AccessLogEntry
+	nextIndex int
+}
+
+// NewAccessLogger creates an AccessLogger with a configuration.
+func NewAccessLogger(config AccessLogConfig) *AccessLogger {
+	return &AccessLogger{config: config, files: map[string]io.WriteCloser{}}
+}
+
+// Config returns the logger's current configuration.
+func (a *AccessLogger) Config() AccessLogConfig {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.config
+}
+
+// SetConfig changes the logger's configuration and closes its open files.
+func (a *AccessLogger) SetConfig(config AccessLogConfig) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.config = config
+	for _, f := range a.files {
+		f.Close()
+	}
+	a.files = map[string]io.WriteCloser{}
+}
+
+// Log records an entry in the main log, and also in hostPath if it is not "".
+func (a *AccessLogger) Log(entry *AccessLogEntry, hostPath string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(a.recent) < MaxAccessLogEntries {
+		a.recent = append(a.recent, *entry)
+	} else {
+		a.recent[a.nextIndex] = *entry
+		a.nextIndex = (a.nextIndex + 1) % MaxAccessLogEntries
+	}
+
+	var line []byte
+	if a.config.Format == AccessLogJSON {
+		line, _ = json.Marshal(entry)
+	} else {
+		line = []byte(entry.Combined())
+	}
+	line = append(line, '\n')
+
+	for _, path := range []string{a.config.Path, hostPath} {
+		if path == "" {
+			continue
+		}
+		f, err := a.file(path)
+		if err == nil {
+			_, err = f.Write(line)
+		}
+		if err != nil {
+			log.Print("Failed to write access log: " + err.Error())
+		}
+	}
+}
+
+// Recent returns the most recent entries, oldest first.
+func (a *AccessLogger) Recent() []AccessLogEntry {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	res := make([]AccessLogEntry, 0, len(a.recent))
+	res = append(res, a.recent[a.nextIndex:]...)
+	res = append(res, a.recent[:a.nextIndex]...)
+	return res
+}
+
+func (a *AccessLogger) file(path string) (io.WriteCloser, error) {
+	if f, ok := a.files[path]; ok {
+		return f, nil
+	}
+	var f io.WriteCloser
+	if path == "-" {
+		f = nopCloser{os.Stdout}
+	} else {
+		var err error
+		f, err = openRotatingFile(path, int64(a.config.MaxSize)<<20, a.config.MaxFiles)
+		if err != nil {
+			return nil, err
+		}
+	}
+	a.files[path] = f
+	return f, nil
+}
+
+// tlsVersionName returns a human-readable name for a TLS version.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return "0x" + strconv.FormatUint(uint64(version), 16)
+}
+
+// A rotatingFile is an append-only log file which is renamed to path.1, path.2, etc. when it
+// reaches a maximum size.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	res := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := res.open(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	if r.maxFiles == 0 {
+		os.Remove(r.path)
+	} else {
+		for i := r.maxFiles - 1; i > 0; i-- {
+			os.Rename(r.path+"."+strconv.Itoa(i), r.path+"."+strconv.Itoa(i+1))
+		}
+		os.Rename(r.path, r.path+".1")
+	}
+	return r.open()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
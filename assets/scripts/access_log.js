@@ -0,0 +1,46 @@
+(function() {
+
+  $(function() {
+    var $content = $('#access-log-entries');
+    if (window.accessLog.length === 0) {
+      $content.append('<label class="no-requests">No requests</label>');
+      return;
+    }
+    // Show the newest requests first.
+    for (var i = window.accessLog.length - 1; i >= 0; --i) {
+      var entry = window.accessLog[i];
+      var $row = $('<div class="request"><label class="date"></label>' +
+        '<label class="status"></label><label class="summary"></label>' +
+        '<label class="details"></label></div>');
+      $row.find('.date').text(formatTimestamp(entry.Time));
+      $row.find('.status').text(entry.Status);
+      $row.find('.summary').text(entry.Method + ' ' + entry.Host + entry.Path);
+      $row.find('.details').text(entry.ClientIP + ' → ' + (entry.Upstream || '-') +
+        ', ' + entry.Bytes + ' bytes, ' + entry.Latency.toFixed(1) + ' ms' +
+        (entry.TLSVersion ? ', ' + entry.TLSVersion : ''));
+      $row.addClass('status-' + Math.floor(entry.Status / 100) + 'xx');
+      $content.append($row);
+    }
+  });
+
+  function formatTime(millis) {
+    var date = new Date(millis);
+    var h = date.getHours();
+    var m = date.getMinutes();
+    if (m < 10) {
+      m = '0' + m;
+    }
+    var s = date.getSeconds();
+    if (s < 10) {
+      s = '0' + s;
+    }
+    return h + ':' + m + ':' + s;
+  }
+
+  function formatTimestamp(millis) {
+    var date = new Date(millis);
+    return (date.getMonth()+1) + "/" + date.getDate() + "/" + date.getFullYear() + " " +
+      formatTime(millis);
+  }
+
+})();
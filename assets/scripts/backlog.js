@@ -10,8 +10,13 @@
     for (var i = 0, len = window.backlog.length; i < len; ++i) {
       var entry = window.backlog[i];
       var $row = $('<div class="entry"><label class="date"></label>' +
-        '<label class="message"></label></div>');
+        '<label class="replica"></label><label class="message"></label></div>');
       $row.find('.date').text(formatTimestamp(entry.Time));
+      if (window.showReplicas) {
+        $row.find('.replica').text('#' + (entry.Replica || 0));
+      } else {
+        $row.find('.replica').remove();
+      }
       $row.find('.message').text(entry.Data);
       $row.addClass(['stdout', 'stderr', 'status'][entry.Type]);
       $content.append($row);
@@ -0,0 +1,104 @@
+(function() {
+
+  var MAX_OUTPUT = 200000;
+
+  function Console() {
+    this._$output = $('.console-output');
+    this._$status = $('.console-status');
+    this._text = '';
+    this._pending = '';
+    this._decoder = new TextDecoder();
+    this._socket = null;
+    this._connect();
+  }
+
+  Console.prototype.send = function(message) {
+    if (this._socket === null || this._socket.readyState !== WebSocket.OPEN) {
+      this._setStatus('Not connected');
+      return;
+    }
+    this._socket.send(JSON.stringify(message));
+  };
+
+  Console.prototype._connect = function() {
+    var scheme = (window.location.protocol === 'https:' ? 'wss:' : 'ws:');
+    var url = scheme + '//' + window.location.host + '/console_socket?id=' +
+      window.consoleTask.id + '&replica=' + window.consoleTask.replica;
+    this._socket = new WebSocket(url);
+    this._socket.binaryType = 'arraybuffer';
+    this._socket.onopen = this._setStatus.bind(this, 'Connected');
+    this._socket.onclose = this._setStatus.bind(this, 'Disconnected; reload to reconnect');
+    this._socket.onmessage = function(e) {
+      if (typeof e.data === 'string') {
+        this._setStatus(JSON.parse(e.data).error);
+      } else {
+        this._write(this._decoder.decode(new Uint8Array(e.data), {stream: true}));
+      }
+    }.bind(this);
+  };
+
+  Console.prototype._setStatus = function(status) {
+    this._$status.text(status);
+  };
+
+  // _write appends terminal output. Escape sequences are dropped, since the console only shows
+  // plain text.
+  Console.prototype._write = function(data) {
+    data = this._pending + data;
+    this._pending = '';
+    var incomplete = /\x1b(\[[0-9;?]*[ -\/]*|\][^\x07\x1b]*)?$/.exec(data);
+    if (incomplete) {
+      this._pending = incomplete[0];
+      data = data.substr(0, incomplete.index);
+    }
+    data = data.replace(/\x1b\][^\x07\x1b]*(\x07|\x1b\\)/g, '')
+      .replace(/\x1b\[[0-9;?]*[ -\/]*[@-~]/g, '')
+      .replace(/\x1b[^\[\]]/g, '')
+      .replace(/\r\n/g, '\n');
+
+    var text = this._text;
+    for (var i = 0; i < data.length; ++i) {
+      var ch = data[i];
+      if (ch === '\r') {
+        text = text.substr(0, text.lastIndexOf('\n') + 1);
+      } else if (ch === '\b') {
+        if (text.length > 0 && text[text.length - 1] !== '\n') {
+          text = text.substr(0, text.length - 1);
+        }
+      } else if (ch === '\n' || ch === '\t' || ch >= ' ') {
+        text += ch;
+      }
+    }
+    if (text.length > MAX_OUTPUT) {
+      text = text.substr(text.length - MAX_OUTPUT);
+    }
+    this._text = text;
+
+    var atBottom = ($(window).scrollTop() + $(window).height() >= $(document).height() - 20);
+    this._$output.text(text);
+    if (atBottom) {
+      $(document).scrollTop($(document).height());
+    }
+  };
+
+  $(function() {
+    var taskConsole = new Console();
+    $('.console-input-form').submit(function(e) {
+      e.preventDefault();
+      var $input = $('.console-input');
+      taskConsole.send({Input: $input.val() + '\r'});
+      $input.val('');
+    });
+    $('.console-key').click(function() {
+      taskConsole.send({Input: String.fromCharCode(parseInt($(this).data('key')))});
+      $('.console-input').focus();
+    });
+    $('.console-send-signal').click(function() {
+      taskConsole.send({Signal: $('.console-signal').val()});
+    });
+    $('.console-replica').change(function() {
+      window.location = '/console?id=' + window.consoleTask.id + '&replica=' + $(this).val();
+    });
+  });
+
+})();
@@ -1,44 +1,412 @@
 (function() {
 
+  var targetHealth = {};
+  var limitStats = {};
+
   function addRule() {
-    $('#rules').append(createRuleElement('', ['']));
+    $('#rules').append(createRuleElement('', {Targets: [{Host: '', Weight: 1}]}));
   }
 
-  function createRuleElement(host, targets) {
+  function createRuleElement(host, rule) {
     var $element = $('<div></div>', {class: 'rule'});
+    $element.data('rule', rule);
     var $input = $('<input></input>', {
       value: host,
       placeholder: 'Host',
       class: 'host-name'
     });
+    var $priority = $('<input></input>', {
+      value: rule.Priority || 0,
+      placeholder: 'Priority',
+      title: 'Regular expression rules are tried in order of increasing priority',
+      class: 'rule-priority'
+    });
+    var updatePriorityVisibility = function() {
+      var isRegexp = ($input.val().charAt(0) === '~');
+      $priority.css({display: isRegexp ? 'inline-block' : 'none'});
+    };
+    $input.on('input', updatePriorityVisibility);
+    updatePriorityVisibility();
+    var $accessLog = $('<input></input>', {
+      value: rule.AccessLog || '',
+      placeholder: 'Access log file (optional)',
+      class: 'rule-access-log'
+    });
+    var $remove = $('<button>Remove</button>').click(function() {
+      $element.remove();
+    });
+    var $route = createRouteElement(rule, targetHealth[host] || {});
+    var $add = $('<button>Add Target</button>').click(function() {
+      $route.children('.targets').append(createTargetElement({Host: '', Weight: 1}, null));
+    });
+    var $paths = $('<div></div>', {class: 'paths'});
+    var $addPath = $('<button>Add Path</button>').click(function() {
+      $paths.append(createPathElement(host, {Prefix: '/', Targets: [{Host: '', Weight: 1}]}));
+    });
+    var paths = (rule.Paths || []);
+    for (var i = 0, len = paths.length; i < len; ++i) {
+      $paths.append(createPathElement(host, paths[i]));
+    }
+    $element.append($input, $priority, $accessLog, $remove, $add, $addPath, $route,
+      createHeadersElement(rule.Headers), createLimitsElement(rule.Limits, limitStats[host]),
+      createAccessElement(rule.Access), createAuthElement(rule.Auth),
+      createErrorPagesElement(rule.ErrorPages), createMaintenanceElement(rule.Maintenance),
+      $paths);
+    return $element;
+  }
+
+  function createAccessElement(access) {
+    var $element = $('<div class="access"><label>Clients</label>' +
+      '<input class="access-allow" placeholder="Allow (e.g. 10.0.0.0/8, 1.2.3.4)">' +
+      '<input class="access-deny" placeholder="Deny"></div>');
+    access = (access || {});
+    $element.find('.access-allow').val((access.Allow || []).join(', '));
+    $element.find('.access-deny').val((access.Deny || []).join(', '));
+    return $element;
+  }
+
+  function createAuthElement(auth) {
+    var $element = $('<div class="auth"><label>Auth</label>' +
+      '<select class="auth-type"><option value="">None</option>' +
+      '<option value="basic">Basic</option><option value="session">Panel login</option>' +
+      '</select><input class="auth-realm" placeholder="Realm">' +
+      '<input class="auth-login-url" placeholder="Login URL, e.g. https://admin.example.com/login">' +
+      '<button class="auth-add-user">Add User</button><div class="auth-users"></div></div>');
+    auth = (auth || {});
+    var $type = $element.find('.auth-type');
+    var $users = $element.find('.auth-users');
+    $type.val(auth.Type || '');
+    $element.find('.auth-realm').val(auth.Realm || '');
+    $element.find('.auth-login-url').val(auth.LoginURL || '');
+    var users = Object.keys(auth.Users || {}).sort();
+    for (var i = 0; i < users.length; ++i) {
+      $users.append(createUserElement(users[i], auth.Users[users[i]]));
+    }
+    $element.find('.auth-add-user').click(function() {
+      $users.append(createUserElement('', ''));
+    });
+    var updateVisibility = function() {
+      var type = $type.val();
+      var basicDisplay = (type === 'basic' ? 'inline-block' : 'none');
+      $element.find('.auth-realm, .auth-add-user').css({display: basicDisplay});
+      $users.css({display: type === 'basic' ? 'block' : 'none'});
+      $element.find('.auth-login-url').css({
+        display: type === 'session' ? 'inline-block' : 'none'
+      });
+    };
+    $type.change(updateVisibility);
+    updateVisibility();
+    return $element;
+  }
+
+  function createErrorPagesElement(pages) {
+    var $element = $('<div class="error-pages"><label>Error pages</label></div>');
+    pages = (pages || {});
+    var statuses = ['502', '503', '504'];
+    for (var i = 0; i < statuses.length; ++i) {
+      $element.append(createPageUploadElement(statuses[i], pages[statuses[i]] || '')
+        .attr('data-status', statuses[i]));
+    }
+    return $element;
+  }
+
+  function createMaintenanceElement(maintenance) {
+    var $element = $('<div class="maintenance"><label>Maintenance</label>' +
+      '<label><input type="checkbox" class="maintenance-enabled">Enabled</label>' +
+      '<input class="maintenance-retry" placeholder="Retry after (seconds)">' +
+      '<input class="maintenance-allow" placeholder="Allowed clients"></div>');
+    maintenance = (maintenance || {});
+    $element.data('maintenance', maintenance);
+    $element.find('.maintenance-enabled').prop('checked', !!maintenance.Enabled);
+    $element.find('.maintenance-retry').val(maintenance.RetryAfter || '');
+    $element.find('.maintenance-allow').val((maintenance.Allow || []).join(', '));
+    $element.append(createPageUploadElement('Page', maintenance.Page || ''));
+    return $element;
+  }
+
+  // createPageUploadElement creates a control which loads an HTML file into its 'page' data.
+  function createPageUploadElement(name, page) {
+    var $element = $('<span class="page-upload"><label class="page-name"></label>' +
+      '<label class="page-state"></label><input type="file" accept=".html,.htm,text/html">' +
+      '<button>Clear</button></span>');
+    var $state = $element.find('.page-state');
+    var setPage = function(html) {
+      $element.data('page', html);
+      $state.text(html ? 'custom' : 'default');
+    };
+    $element.find('.page-name').text(name);
+    setPage(page);
+    var $file = $element.find('input');
+    $file.change(function() {
+      var file = $file[0].files[0];
+      if (!file) {
+        return;
+      }
+      var reader = new FileReader();
+      reader.onload = function() {
+        setPage(reader.result);
+      };
+      reader.readAsText(file);
+    });
+    $element.find('button').click(function() {
+      $file.val('');
+      setPage('');
+    });
+    return $element;
+  }
+
+  function createUserElement(name, hash) {
+    var $element = $('<div class="auth-user"><input class="auth-user-name" placeholder="User">' +
+      '<input class="auth-user-password" type="password" autocomplete="off">' +
+      '<button>Remove</button></div>');
+    $element.data('hash', hash);
+    $element.find('.auth-user-name').val(name);
+    $element.find('.auth-user-password').attr('placeholder',
+      hash ? 'Unchanged' : 'Password');
+    $element.find('button').click(function() {
+      $element.remove();
+    });
+    return $element;
+  }
+
+  function createLimitsElement(limits, stats) {
+    var $element = $('<div class="limits"><label>Limits</label>' +
+      '<input class="limits-rate" placeholder="Requests/sec">' +
+      '<input class="limits-burst" placeholder="Burst">' +
+      '<input class="limits-key-header" placeholder="Client header (default IP)">' +
+      '<input class="limits-max-conns" placeholder="Max connections">' +
+      '<input class="limits-max-target-conns" placeholder="Max per target"></div>');
+    limits = (limits || {});
+    $element.find('.limits-rate').val(limits.Rate || '');
+    $element.find('.limits-burst').val(limits.Burst || '');
+    $element.find('.limits-key-header').val(limits.KeyHeader || '');
+    $element.find('.limits-max-conns').val(limits.MaxConns || '');
+    $element.find('.limits-max-target-conns').val(limits.MaxTargetConns || '');
+    if (stats && (stats.RateRejected || stats.ConnRejected)) {
+      var $stats = $('<label class="limits-stats"></label>');
+      $stats.text('Rejected ' + stats.RateRejected + ' by rate, ' + stats.ConnRejected +
+        ' by connections');
+      $element.append($stats);
+    }
+    return $element;
+  }
+
+  function createHeadersElement(headers) {
+    var $element = $('<div class="headers"><label>Headers</label>' +
+      '<button>Add Header</button><div class="header-list"></div></div>');
+    var $list = $element.find('.header-list');
+    $element.children('button').click(function() {
+      $list.append(createHeaderElement('Response', 'Set', '', ''));
+    });
+    headers = (headers || {});
+    var directions = ['Request', 'Response'];
+    for (var i = 0; i < directions.length; ++i) {
+      var direction = directions[i];
+      var actions = (headers[direction] || {});
+      var removed = (actions.Remove || []);
+      for (var j = 0; j < removed.length; ++j) {
+        $list.append(createHeaderElement(direction, 'Remove', removed[j], ''));
+      }
+      var kinds = ['Set', 'Add'];
+      for (var j = 0; j < kinds.length; ++j) {
+        var values = (actions[kinds[j]] || {});
+        var names = Object.keys(values).sort();
+        for (var k = 0; k < names.length; ++k) {
+          $list.append(createHeaderElement(direction, kinds[j], names[k], values[names[k]]));
+        }
+      }
+    }
+    return $element;
+  }
+
+  function createHeaderElement(direction, kind, name, value) {
+    var $element = $('<div class="header">' +
+      '<select class="header-direction"><option>Request</option>' +
+      '<option>Response</option></select>' +
+      '<select class="header-kind"><option>Set</option><option>Add</option>' +
+      '<option>Remove</option></select>' +
+      '<input class="header-name" placeholder="Header">' +
+      '<input class="header-value" placeholder="Value, e.g. {client_ip}">' +
+      '<button>Remove</button></div>');
+    var $kind = $element.find('.header-kind');
+    var $value = $element.find('.header-value');
+    $element.find('.header-direction').val(direction);
+    $kind.val(kind);
+    $element.find('.header-name').val(name);
+    $value.val(value);
+    var updateVisibility = function() {
+      $value.css({display: $kind.val() === 'Remove' ? 'none' : 'inline-block'});
+    };
+    $kind.change(updateVisibility);
+    updateVisibility();
+    $element.find('button').click(function() {
+      $element.remove();
+    });
+    return $element;
+  }
+
+  function createPathElement(host, pathRule) {
+    var $element = $('<div></div>', {class: 'path-rule'});
+    $element.data('rule', pathRule);
+    var $prefix = $('<input></input>', {
+      value: pathRule.Prefix,
+      placeholder: 'Path prefix',
+      class: 'path-prefix'
+    });
+    var $strip = $('<label class="path-strip-label"><input type="checkbox" ' +
+      'class="path-strip">Strip prefix</label>');
+    $strip.find('input').prop('checked', !!pathRule.StripPrefix);
+    var $addPrefix = $('<input></input>', {
+      value: pathRule.AddPrefix || '',
+      placeholder: 'Add prefix',
+      class: 'path-add-prefix'
+    });
     var $remove = $('<button>Remove</button>').click(function() {
       $element.remove();
     });
+    var $route = createRouteElement(pathRule, targetHealth[host + pathRule.Prefix] || {});
     var $add = $('<button>Add Target</button>').click(function() {
-      $element.append(createTargetElement(''));
+      $route.children('.targets').append(createTargetElement({Host: '', Weight: 1}, null));
     });
-    $element.append($input, $remove, $add);
+    $element.append($prefix, $strip, $addPrefix, $remove, $add, $route);
+    return $element;
+  }
+
+  function createRouteElement(route, health) {
+    var $element = $('<div></div>', {class: 'route'});
+    var $mode = $('<div class="route-mode"><label>Action</label><select>' +
+      '<option value="proxy">Forward to targets</option>' +
+      '<option value="static">Serve directory</option>' +
+      '<option value="redirect">Redirect</option></select></div>');
+    var $proxy = $('<div></div>', {class: 'route-proxy'});
+    var $targets = $('<div></div>', {class: 'targets'});
+    var targets = (route.Targets || []);
     for (var i = 0, len = targets.length; i < len; ++i) {
-      $element.append(createTargetElement(targets[i]));
+      var target = targets[i];
+      $targets.append(createTargetElement(target, health[target.Host] || null));
     }
+    $proxy.append(createBalanceElement(route), createHealthCheckElement(route.HealthCheck));
+    var $static = createStaticElement(route.Static);
+    var $redirect = createRedirectElement(route.Redirect);
+    $element.append($mode, $redirect, $proxy, $static, $targets);
+
+    var $select = $mode.find('select');
+    $select.val(route.Redirect ? 'redirect' : (route.Static ? 'static' : 'proxy'));
+    var $insecure = $redirect.find('.redirect-insecure');
+    var updateVisibility = function() {
+      var mode = $select.val();
+      // Redirects which only apply to plain HTTP forward secure requests to the targets.
+      var forwards = mode === 'proxy' || (mode === 'redirect' && $insecure.is(':checked'));
+      $proxy.css({display: forwards ? 'block' : 'none'});
+      $targets.css({display: forwards ? 'block' : 'none'});
+      $static.css({display: mode === 'static' ? 'block' : 'none'});
+      $redirect.css({display: mode === 'redirect' ? 'block' : 'none'});
+    };
+    $select.change(updateVisibility);
+    $insecure.change(updateVisibility);
+    updateVisibility();
+    return $element;
+  }
+
+  function createStaticElement(site) {
+    var $element = $('<div class="static-site">' +
+      '<input class="static-root" placeholder="Directory, e.g. /var/www/site">' +
+      '<input class="static-index" placeholder="Index files (default index.html)">' +
+      '<input class="static-cache" placeholder="Cache-Control">' +
+      '<label><input type="checkbox" class="static-spa">SPA fallback</label>' +
+      '<label><input type="checkbox" class="static-precompressed">Precompressed</label>' +
+      '<label><input type="checkbox" class="static-listing">Listings</label></div>');
+    site = (site || {});
+    $element.data('site', site);
+    $element.find('.static-root').val(site.Root || '');
+    $element.find('.static-index').val((site.Index || []).join(', '));
+    $element.find('.static-cache').val(site.CacheControl || '');
+    $element.find('.static-spa').prop('checked', !!site.SPA);
+    $element.find('.static-precompressed').prop('checked', !!site.Precompressed);
+    $element.find('.static-listing').prop('checked', !!site.Listing);
     return $element;
   }
 
-  function createTargetElement(hostname) {
+  function createRedirectElement(redirect) {
+    var $element = $('<div class="redirect">' +
+      '<select class="redirect-status"><option value="301">301 Moved Permanently</option>' +
+      '<option value="302">302 Found</option>' +
+      '<option value="307">307 Temporary Redirect</option>' +
+      '<option value="308">308 Permanent Redirect</option></select>' +
+      '<input class="redirect-url" placeholder="URL, e.g. https://www.{host}{uri}">' +
+      '<label><input type="checkbox" class="redirect-insecure">Only plain HTTP</label></div>');
+    redirect = (redirect || {});
+    $element.data('redirect', redirect);
+    $element.find('.redirect-status').val('' + (redirect.Status || 301));
+    $element.find('.redirect-url').val(redirect.URL || '');
+    $element.find('.redirect-insecure').prop('checked', !!redirect.InsecureOnly);
+    return $element;
+  }
+
+  function createBalanceElement(route) {
+    var $element = $('<div class="balance"><label>Balancing</label>' +
+      '<select class="balance-mode"><option value="random">Random</option>' +
+      '<option value="round-robin">Round-robin</option>' +
+      '<option value="least-conn">Least connections</option>' +
+      '<option value="ip-hash">Hash client IP</option>' +
+      '<option value="cookie-hash">Hash cookie</option></select>' +
+      '<input class="balance-cookie" placeholder="Cookie name"></div>');
+    var $mode = $element.find('.balance-mode');
+    var $cookie = $element.find('.balance-cookie');
+    $mode.val(route.Balance || 'random');
+    $cookie.val(route.HashCookie || '');
+    var updateVisibility = function() {
+      $cookie.css({display: $mode.val() === 'cookie-hash' ? 'inline-block' : 'none'});
+    };
+    $mode.change(updateVisibility);
+    updateVisibility();
+    return $element;
+  }
+
+  function createHealthCheckElement(check) {
+    var $element = $('<div class="health-check"><label>Health check</label>' +
+      '<select class="health-type"><option value="">None</option>' +
+      '<option value="http">HTTP</option><option value="tcp">TCP</option></select>' +
+      '<input class="health-path" placeholder="Path">' +
+      '<input class="health-interval" placeholder="Interval (sec)"></div>');
+    check = (check || {});
+    $element.find('.health-type').val(check.Type || '');
+    $element.find('.health-path').val(check.Path || '');
+    $element.find('.health-interval').val(check.Interval || '');
+    $element.data('check', check);
+    return $element;
+  }
+
+  function createTargetElement(target, health) {
     var $element = $('<div></div>', {class: 'target'});
     var $input = $('<input></input>', {
-      value: hostname,
+      value: target.Host,
       placeholder: 'Target',
       class: 'target-name'
     });
+    var $weight = $('<input></input>', {
+      value: target.Weight || 1,
+      placeholder: 'Weight',
+      class: 'target-weight'
+    });
     var $remove = $('<button>Remove</button>').click(function() {
       $element.remove();
     });
-    $element.append($input, $remove);
+    $element.append($input, $weight, $remove);
+    if (health !== null) {
+      var $status = $('<label></label>', {
+        class: 'target-health ' + (health.Up ? 'target-up' : 'target-down'),
+        title: health.LastError
+      });
+      $status.text(health.Up ? 'Up' : 'Down');
+      $element.append($status);
+    }
     return $element;
   }
 
-  function loadRules(rules) {
+  function loadRules(rules, health, stats) {
+    targetHealth = (health || {});
+    limitStats = (stats || {});
     // Get a sorted list of hosts.
     var hosts = [];
     for (var key in rules) {
@@ -52,24 +420,214 @@
     var $container = $('#rules');
     for (var i = 0, len = hosts.length; i < len; ++i) {
       var key = hosts[i];
-      var targets = rules[key];
-      var $element = createRuleElement(key, targets);
+      var $element = createRuleElement(key, rules[key]);
       $container.append($element);
     }
   }
 
+  function readHealthCheck($element) {
+    var type = $element.find('.health-type').val();
+    if (!type) {
+      return null;
+    }
+    var check = $.extend({}, $element.data('check'));
+    check.Type = type;
+    check.Path = $element.find('.health-path').val();
+    check.Interval = parseInt($element.find('.health-interval').val()) || 0;
+    return check;
+  }
+
+  function readHeaders($element) {
+    var $headers = $element.find('.header');
+    if ($headers.length === 0) {
+      return null;
+    }
+    var result = {
+      Request: {Remove: [], Set: {}, Add: {}},
+      Response: {Remove: [], Set: {}, Add: {}}
+    };
+    for (var i = 0, len = $headers.length; i < len; ++i) {
+      var $header = $headers.eq(i);
+      var actions = result[$header.find('.header-direction').val()];
+      var kind = $header.find('.header-kind').val();
+      var name = $header.find('.header-name').val();
+      if (kind === 'Remove') {
+        actions.Remove.push(name);
+      } else {
+        actions[kind][name] = $header.find('.header-value').val();
+      }
+    }
+    return result;
+  }
+
+  function readAccess($element) {
+    var access = {
+      Allow: splitList($element.find('.access-allow').val()),
+      Deny: splitList($element.find('.access-deny').val())
+    };
+    if (access.Allow.length === 0 && access.Deny.length === 0) {
+      return null;
+    }
+    return access;
+  }
+
+  function splitList(list) {
+    var result = [];
+    var items = list.split(',');
+    for (var i = 0; i < items.length; ++i) {
+      var item = $.trim(items[i]);
+      if (item) {
+        result.push(item);
+      }
+    }
+    return result;
+  }
+
+  function readAuth($element) {
+    var type = $element.find('.auth-type').val();
+    if (!type) {
+      return null;
+    }
+    var auth = {
+      Type: type,
+      Realm: $element.find('.auth-realm').val(),
+      LoginURL: $element.find('.auth-login-url').val(),
+      Users: {},
+      NewPasswords: {}
+    };
+    $element.find('.auth-user').each(function(i, user) {
+      var $user = $(user);
+      var name = $user.find('.auth-user-name').val();
+      var password = $user.find('.auth-user-password').val();
+      if (password) {
+        auth.NewPasswords[name] = password;
+      } else if ($user.data('hash')) {
+        auth.Users[name] = $user.data('hash');
+      }
+    });
+    return auth;
+  }
+
+  function readErrorPages($element) {
+    var pages = {};
+    var empty = true;
+    $element.find('.page-upload').each(function(i, upload) {
+      var $upload = $(upload);
+      if ($upload.data('page')) {
+        pages[$upload.attr('data-status')] = $upload.data('page');
+        empty = false;
+      }
+    });
+    return empty ? null : pages;
+  }
+
+  function readMaintenance($element) {
+    var maintenance = $.extend({}, $element.data('maintenance'));
+    maintenance.Enabled = $element.find('.maintenance-enabled').is(':checked');
+    maintenance.RetryAfter = parseInt($element.find('.maintenance-retry').val()) || 0;
+    maintenance.Allow = splitList($element.find('.maintenance-allow').val());
+    maintenance.Page = $element.find('.page-upload').data('page') || '';
+    if (!maintenance.Enabled && !maintenance.RetryAfter && maintenance.Allow.length === 0 &&
+        !maintenance.Page) {
+      return null;
+    }
+    return maintenance;
+  }
+
+  function readLimits($element) {
+    var limits = {
+      Rate: parseFloat($element.find('.limits-rate').val()) || 0,
+      Burst: parseInt($element.find('.limits-burst').val()) || 0,
+      KeyHeader: $element.find('.limits-key-header').val(),
+      MaxConns: parseInt($element.find('.limits-max-conns').val()) || 0,
+      MaxTargetConns: parseInt($element.find('.limits-max-target-conns').val()) || 0
+    };
+    if (!limits.Rate && !limits.MaxConns && !limits.MaxTargetConns) {
+      return null;
+    }
+    return limits;
+  }
+
+  function readStatic($element) {
+    var site = $.extend({}, $element.data('site'));
+    site.Root = $element.find('.static-root').val();
+    site.Index = splitList($element.find('.static-index').val());
+    site.CacheControl = $element.find('.static-cache').val();
+    site.SPA = $element.find('.static-spa').is(':checked');
+    site.Precompressed = $element.find('.static-precompressed').is(':checked');
+    site.Listing = $element.find('.static-listing').is(':checked');
+    return site;
+  }
+
+  function readRedirect($element) {
+    var redirect = $.extend({}, $element.data('redirect'));
+    redirect.Status = parseInt($element.find('.redirect-status').val());
+    redirect.URL = $element.find('.redirect-url').val();
+    redirect.InsecureOnly = $element.find('.redirect-insecure').is(':checked');
+    return redirect;
+  }
+
+  function readRoute($route, route) {
+    var mode = $route.children('.route-mode').find('select').val();
+    route.Targets = [];
+    route.Static = null;
+    route.Redirect = null;
+    if (mode === 'static') {
+      route.Static = readStatic($route.children('.static-site'));
+      return route;
+    } else if (mode === 'redirect') {
+      route.Redirect = readRedirect($route.children('.redirect'));
+      if (!route.Redirect.InsecureOnly) {
+        return route;
+      }
+    }
+    var $targets = $route.children('.targets').children('.target');
+    for (var i = 0, len = $targets.length; i < len; ++i) {
+      route.Targets[i] = {
+        Host: $targets.eq(i).find('.target-name').val(),
+        Weight: parseInt($targets.eq(i).find('.target-weight').val()) || 1
+      };
+    }
+    var $proxy = $route.children('.route-proxy');
+    route.Balance = $proxy.find('.balance-mode').val();
+    route.HashCookie = $proxy.find('.balance-cookie').val();
+    route.HealthCheck = readHealthCheck($proxy.children('.health-check'));
+    return route;
+  }
+
+  function readPath($path) {
+    var pathRule = readRoute($path.children('.route'), $.extend({}, $path.data('rule')));
+    pathRule.Prefix = $path.children('.path-prefix').val();
+    pathRule.StripPrefix = $path.find('.path-strip').is(':checked');
+    pathRule.AddPrefix = $path.children('.path-add-prefix').val();
+    return pathRule;
+  }
+
+  function readRule($rule) {
+    var rule = readRoute($rule.children('.route'), $.extend({}, $rule.data('rule')));
+    var $paths = $rule.children('.paths').children('.path-rule');
+    rule.Paths = [];
+    for (var i = 0, len = $paths.length; i < len; ++i) {
+      rule.Paths[i] = readPath($paths.eq(i));
+    }
+    rule.Priority = parseInt($rule.children('.rule-priority').val()) || 0;
+    rule.Headers = readHeaders($rule.children('.headers'));
+    rule.AccessLog = $rule.children('.rule-access-log').val();
+    rule.Limits = readLimits($rule.children('.limits'));
+    rule.Access = readAccess($rule.children('.access'));
+    rule.Auth = readAuth($rule.children('.auth'));
+    rule.ErrorPages = readErrorPages($rule.children('.error-pages'));
+    rule.Maintenance = readMaintenance($rule.children('.maintenance'));
+    return rule;
+  }
+
   function save() {
     var result = {};
     var $rules = $('.rule');
     for (var i = 0, len = $rules.length; i < len; ++i) {
       var $rule = $rules.eq(i);
-      var name = $rule.find('input.host-name').val();
-      var targets = $rule.find('input.target-name');
-      var targetNames = [];
-      for (var j = 0, len1 = targets.length; j < len1; ++j) {
-        targetNames[j] = targets.eq(j).val();
-      }
-      result[name] = targetNames;
+      var name = $rule.children('input.host-name').val();
+      result[name] = readRule($rule);
     }
     postData('rules', JSON.stringify(result), '/setrules');
   }
@@ -0,0 +1,57 @@
+(function() {
+
+  function runCommand(command, timeout) {
+    var $output = $('.run-output');
+    var $button = $('.run-button');
+    $output.text('').show();
+    $button.attr('disabled', true);
+    var started = new Date().getTime();
+
+    var xhr = new XMLHttpRequest();
+    xhr.open('POST', '/run_command?id=' + window.taskID);
+    xhr.setRequestHeader('Content-Type', 'application/x-www-form-urlencoded');
+    xhr.onprogress = function() {
+      $output.text(xhr.responseText);
+    };
+    xhr.onloadend = function() {
+      $output.text(xhr.responseText || ('Request failed: ' + xhr.statusText));
+      $button.attr('disabled', false);
+      addHistory({Time: started, Command: command, Result: lastResult(xhr)});
+    };
+    xhr.send($.param({command: command, timeout: timeout}));
+  }
+
+  function lastResult(xhr) {
+    if (xhr.status !== 200) {
+      return 'error';
+    }
+    var match = /\[([^\[\]]*)\]\s*$/.exec(xhr.responseText);
+    return (match ? match[1] : '');
+  }
+
+  function addHistory(entry) {
+    var $row = $('<div class="run-history-entry"><label class="date"></label>' +
+      '<code class="command"></code><label class="result"></label></div>');
+    $row.find('.date').text(new Date(entry.Time).toLocaleString());
+    $row.find('.command').text(entry.Command);
+    $row.find('.result').text(entry.Result || 'running');
+    $row.find('.command').click(function() {
+      $('.run-command').val(entry.Command).focus();
+    });
+    $('.run-history').prepend($row);
+  }
+
+  $(function() {
+    for (var i = 0; i < window.commandHistory.length; ++i) {
+      addHistory(window.commandHistory[i]);
+    }
+    $('.run-form').submit(function(e) {
+      e.preventDefault();
+      var command = $.trim($('.run-command').val());
+      if (command) {
+        runCommand(command, $.trim($('.run-timeout').val()));
+      }
+    });
+  });
+
+})();
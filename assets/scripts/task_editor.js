@@ -9,16 +9,29 @@
     UID: 0,
     SetGID: false,
     SetUID: false,
+    User: '',
+    Group: '',
+    InheritEnv: 'all',
+    InheritVars: [],
+    EnvFiles: [],
     Relaunch: false,
-    Interval: 60
+    Interval: 60,
+    Replicas: 1,
+    Schedule: '',
+    TimeZone: '',
+    Overlap: 'skip',
+    DependsOn: []
   };
 
   function TaskEditor($container, task) {
     task = (task || DEFAULT_TASK);
     this._$container = $container;
+    this._proxy = (task.Proxy || {});
+    this._preStop = (task.PreStop || {});
 
     this._initializeArguments(task);
     this._initializeEnvironment(task);
+    this._initializeDependencies(task);
     this._initializeFields(task);
   }
 
@@ -34,6 +47,17 @@
       args.push($(element).val());
     });
 
+    var dependsOn = [];
+    this._$dependencies.children().each(function(i, element) {
+      var $element = $(element);
+      var healthy = ($element.find('.task-editor-dep-condition').val() === 'healthy');
+      dependsOn.push($.extend({}, $element.data('dependency'), {
+        Task: parseInt($element.find('.task-editor-dep-task').val()),
+        Condition: $element.find('.task-editor-dep-condition').val(),
+        Address: healthy ? $.trim($element.find('.task-editor-dep-address').val()) : ''
+      }));
+    });
+
     return {
       Args: args,
       AutoRun: this._getField('auto-launch').is(':checked'),
@@ -43,9 +67,147 @@
       UID: parseInt(this._getField('uid').val()) || 0,
       SetGID: this._getField('set-gid').is(':checked'),
       SetUID: this._getField('set-uid').is(':checked'),
+      User: $.trim(this._getField('user').val()),
+      Group: $.trim(this._getField('group').val()),
+      InheritEnv: this._getField('inherit-env').val(),
+      InheritVars: (this._getField('inherit-env').val() === 'allow' ?
+        this._getList('inherit-vars') : []),
+      EnvFiles: this._getList('env-files'),
       Relaunch: this._getField('auto-relaunch').is(':checked'),
-      Interval: parseInt(this._getField('relaunch-interval').val())
+      Interval: parseInt(this._getField('relaunch-interval').val()),
+      Replicas: parseInt(this._getField('replicas').val()) || 1,
+      Schedule: $.trim(this._getField('schedule').val()),
+      TimeZone: $.trim(this._getField('time-zone').val()),
+      Overlap: this._getField('overlap').val(),
+      Proxy: this._getProxy(),
+      DependsOn: dependsOn,
+      StopSignal: this._getField('stop-signal').val(),
+      StopTimeout: parseInt(this._getField('stop-timeout').val()) || 0,
+      PreStop: this._getPreStop(),
+      Resources: this._getResources(),
+      Sandbox: this._getSandbox(),
+      Terminal: this._getTerminal(),
+      PreStart: this._getLines('pre-start'),
+      PostStart: this._getLines('post-start'),
+      PostStop: this._getLines('post-stop'),
+      HookTimeout: parseInt(this._getField('hook-timeout').val()) || 0
+    };
+  };
+
+  TaskEditor.prototype._getLines = function(name) {
+    var res = [];
+    var lines = this._getField(name).val().split('\n');
+    for (var i = 0; i < lines.length; ++i) {
+      if ($.trim(lines[i])) {
+        res.push($.trim(lines[i]));
+      }
+    }
+    return res;
+  };
+
+  TaskEditor.prototype._getTerminal = function() {
+    if (!this._getField('terminal').is(':checked')) {
+      return null;
+    }
+    return {
+      Rows: parseInt(this._getField('terminal-rows').val()) || 0,
+      Columns: parseInt(this._getField('terminal-columns').val()) || 0
+    };
+  };
+
+  TaskEditor.prototype._getProxy = function() {
+    var host = $.trim(this._getField('proxy-host').val());
+    if (!host) {
+      return null;
+    }
+    var proxy = $.extend({}, this._proxy, {
+      Host: host,
+      Deploy: this._getField('deploy').val()
+    });
+    var checkType = this._getField('health-type').val();
+    if (checkType) {
+      proxy.HealthCheck = $.extend({}, this._proxy.HealthCheck, {
+        Type: checkType,
+        Path: this._getField('health-path').val()
+      });
+    } else {
+      proxy.HealthCheck = null;
+    }
+    return proxy;
+  };
+
+  TaskEditor.prototype._getResources = function() {
+    var field = this._getField.bind(this);
+    var rlimit = function(name) {
+      var value = $.trim(field(name).val());
+      return (value === '' ? null : (parseInt(value) || 0));
+    };
+    var resources = {
+      OpenFiles: rlimit('open-files'),
+      Processes: rlimit('processes'),
+      CoreSize: rlimit('core-size'),
+      CPUTime: rlimit('cpu-time'),
+      MemoryMax: Math.round((parseFloat(field('memory-max').val()) || 0) * 1048576),
+      CPUMax: parseFloat(field('cpu-max').val()) || 0,
+      PidsMax: parseInt(field('pids-max').val()) || 0
     };
+    var keys = Object.keys(resources);
+    for (var i = 0; i < keys.length; ++i) {
+      if (resources[keys[i]]) {
+        return resources;
+      }
+    }
+    // A core size of 0 is a limit, unlike a memory limit of 0.
+    return (resources.CoreSize === 0 ? resources : null);
+  };
+
+  TaskEditor.prototype._getPreStop = function() {
+    var type = this._getField('pre-stop-type').val();
+    var value = $.trim(this._getField('pre-stop').val());
+    if (!type || !value) {
+      return null;
+    }
+    var hook = $.extend({}, this._preStop, {Command: '', URL: ''});
+    if (type === 'command') {
+      hook.Command = value;
+    } else {
+      hook.URL = value;
+    }
+    return hook;
+  };
+
+  TaskEditor.prototype._getList = function(name) {
+    var res = [];
+    var parts = this._getField(name).val().split(',');
+    for (var i = 0; i < parts.length; ++i) {
+      if ($.trim(parts[i])) {
+        res.push($.trim(parts[i]));
+      }
+    }
+    return res;
+  };
+
+  TaskEditor.prototype._getSandbox = function() {
+    var field = this._getField.bind(this);
+    var list = this._getList.bind(this);
+    var mounts = field('mount-ns').is(':checked');
+    var dropCaps = field('drop-caps').is(':checked');
+    var sandbox = {
+      MountNamespace: mounts,
+      PIDNamespace: field('pid-ns').is(':checked'),
+      IPCNamespace: field('ipc-ns').is(':checked'),
+      ReadOnlyPaths: mounts ? list('read-only') : [],
+      PrivateTmp: mounts && field('private-tmp').is(':checked'),
+      NoNewPrivs: field('no-new-privs').is(':checked'),
+      DropCapabilities: dropCaps,
+      Capabilities: dropCaps ? list('capabilities') : [],
+      Seccomp: field('seccomp').val()
+    };
+    if (!sandbox.MountNamespace && !sandbox.PIDNamespace && !sandbox.IPCNamespace &&
+        !sandbox.NoNewPrivs && !sandbox.DropCapabilities && !sandbox.Seccomp) {
+      return null;
+    }
+    return sandbox;
   };
 
   TaskEditor.prototype._addArgument = function() {
@@ -56,6 +218,10 @@
     this._$env.append(createEnvironmentElement('', ''));
   };
 
+  TaskEditor.prototype._addDependency = function() {
+    this._$dependencies.append(createDependencyElement({}));
+  };
+
   TaskEditor.prototype._getField = function(name) {
     return this._$fields.find('.task-editor-' + name);
   };
@@ -87,6 +253,23 @@
     this._$container.append($envTitle, this._$env);
   };
 
+  TaskEditor.prototype._initializeDependencies = function(task) {
+    var $depsTitle = $('<div class="field-set-action-heading">' +
+      '<h1>Depends On</h1><button class="field-set-add-button">Add</button></div>');
+    $depsTitle.find('.field-set-add-button').click(this._addDependency.bind(this));
+    if ((window.taskChoices || []).length === 0) {
+      $depsTitle.find('.field-set-add-button').attr('disabled', true);
+    }
+
+    this._$dependencies = $('<div></div>');
+    var deps = (task.DependsOn || []);
+    for (var i = 0; i < deps.length; ++i) {
+      this._$dependencies.append(createDependencyElement(deps[i]));
+    }
+
+    this._$container.append($depsTitle, this._$dependencies);
+  };
+
   TaskEditor.prototype._initializeFields = function(task) {
     this._$fields = $('<div class="task-editor-fields">' +
 
@@ -106,6 +289,66 @@
       '<label class="input-field-label task-editor">Relaunch interval (sec)</label>' +
       '<input class="input-field-input task-editor-relaunch-interval"></div>' +
 
+      '<div class="field">' +
+      '<label class="input-field-label">Schedule</label>' +
+      '<input class="input-field-input task-editor-schedule" ' +
+      'placeholder="Optional; e.g. 0 3 * * * or @every 1h"></div>' +
+
+      '<div class="field task-editor-time-zone-field">' +
+      '<label class="input-field-label">Time zone</label>' +
+      '<input class="input-field-input task-editor-time-zone" ' +
+      'placeholder="Server time; e.g. America/New_York"></div>' +
+
+      '<div class="field task-editor-overlap-field">' +
+      '<label class="input-field-label">If still running</label>' +
+      '<select class="input-field-input task-editor-overlap">' +
+      '<option value="skip">Skip run</option>' +
+      '<option value="queue">Run when finished</option>' +
+      '<option value="kill">Stop and run again</option></select></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Replicas</label>' +
+      '<input class="input-field-input task-editor-replicas"></div>' +
+
+      '<div class="field">' +
+      '<label class="generic-field-label">Terminal</label>' +
+      '<input class="generic-field-content task-editor-terminal" type="checkbox"></div>' +
+
+      '<div class="field task-editor-terminal-rows-field">' +
+      '<label class="input-field-label">Terminal rows</label>' +
+      '<input class="input-field-input task-editor-terminal-rows" placeholder="24"></div>' +
+
+      '<div class="field task-editor-terminal-columns-field">' +
+      '<label class="input-field-label">Terminal columns</label>' +
+      '<input class="input-field-input task-editor-terminal-columns" placeholder="80"></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">User</label>' +
+      '<input class="input-field-input task-editor-user" ' +
+      'placeholder="Goule\'s user; e.g. www-data"></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Group</label>' +
+      '<input class="input-field-input task-editor-group" ' +
+      'placeholder="User\'s primary group"></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Inherit environment</label>' +
+      '<select class="input-field-input task-editor-inherit-env">' +
+      '<option value="none">None</option>' +
+      '<option value="allow">Listed variables</option>' +
+      '<option value="all">All variables</option></select></div>' +
+
+      '<div class="field task-editor-inherit-vars-field">' +
+      '<label class="input-field-label">Inherited variables</label>' +
+      '<input class="input-field-input task-editor-inherit-vars" ' +
+      'placeholder="Comma-separated, e.g. PATH, LANG"></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Env files</label>' +
+      '<input class="input-field-input task-editor-env-files" ' +
+      'placeholder="Comma-separated, e.g. .env"></div>' +
+
       '<div class="field">' +
       '<label class="generic-field-label">Set GID</label>' +
       '<input class="generic-field-content task-editor-set-gid" type="checkbox"></div>' +
@@ -122,6 +365,136 @@
       '<label class="input-field-label">UID</label>' +
       '<input class="input-field-input task-editor-uid"></div>' +
 
+      '<div class="field">' +
+      '<label class="textarea-field-label">Pre-start commands</label>' +
+      '<textarea class="textarea-field-textarea task-editor-pre-start" ' +
+      'placeholder="One per line, e.g. git pull && make"></textarea></div>' +
+
+      '<div class="field">' +
+      '<label class="textarea-field-label">Post-start commands</label>' +
+      '<textarea class="textarea-field-textarea task-editor-post-start" ' +
+      'placeholder="One per line"></textarea></div>' +
+
+      '<div class="field">' +
+      '<label class="textarea-field-label">Post-stop commands</label>' +
+      '<textarea class="textarea-field-textarea task-editor-post-stop" ' +
+      'placeholder="One per line, e.g. rm -f app.sock"></textarea></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Hook timeout (sec)</label>' +
+      '<input class="input-field-input task-editor-hook-timeout" placeholder="300"></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Stop signal</label>' +
+      '<select class="input-field-input task-editor-stop-signal">' +
+      '<option value="SIGTERM">SIGTERM</option><option value="SIGINT">SIGINT</option>' +
+      '<option value="SIGQUIT">SIGQUIT</option></select></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Stop timeout (sec)</label>' +
+      '<input class="input-field-input task-editor-stop-timeout" placeholder="1"></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Pre-stop hook</label>' +
+      '<select class="input-field-input task-editor-pre-stop-type">' +
+      '<option value="">None</option><option value="command">Command</option>' +
+      '<option value="url">HTTP GET</option></select></div>' +
+
+      '<div class="field task-editor-pre-stop-field">' +
+      '<label class="input-field-label">Pre-stop command or URL</label>' +
+      '<input class="input-field-input task-editor-pre-stop" ' +
+      'placeholder="e.g. http://127.0.0.1:{port}/drain"></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Memory limit (MB)</label>' +
+      '<input class="input-field-input task-editor-memory-max" placeholder="None"></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">CPU limit (CPUs)</label>' +
+      '<input class="input-field-input task-editor-cpu-max" placeholder="None"></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Process limit (total)</label>' +
+      '<input class="input-field-input task-editor-pids-max" placeholder="None"></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Open files (per process)</label>' +
+      '<input class="input-field-input task-editor-open-files" placeholder="Inherit"></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Processes (per user)</label>' +
+      '<input class="input-field-input task-editor-processes" placeholder="Inherit"></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Core size (bytes)</label>' +
+      '<input class="input-field-input task-editor-core-size" placeholder="Inherit"></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">CPU time (sec)</label>' +
+      '<input class="input-field-input task-editor-cpu-time" placeholder="Inherit"></div>' +
+
+      '<div class="field">' +
+      '<label class="generic-field-label">Mount namespace</label>' +
+      '<input class="generic-field-content task-editor-mount-ns" type="checkbox"></div>' +
+
+      '<div class="field task-editor-read-only-field">' +
+      '<label class="input-field-label">Read-only paths</label>' +
+      '<input class="input-field-input task-editor-read-only" ' +
+      'placeholder="Comma-separated, e.g. /usr, /etc"></div>' +
+
+      '<div class="field task-editor-private-tmp-field">' +
+      '<label class="generic-field-label">Private /tmp</label>' +
+      '<input class="generic-field-content task-editor-private-tmp" type="checkbox"></div>' +
+
+      '<div class="field">' +
+      '<label class="generic-field-label">PID namespace</label>' +
+      '<input class="generic-field-content task-editor-pid-ns" type="checkbox"></div>' +
+
+      '<div class="field">' +
+      '<label class="generic-field-label">IPC namespace</label>' +
+      '<input class="generic-field-content task-editor-ipc-ns" type="checkbox"></div>' +
+
+      '<div class="field">' +
+      '<label class="generic-field-label">No new privileges</label>' +
+      '<input class="generic-field-content task-editor-no-new-privs" type="checkbox"></div>' +
+
+      '<div class="field">' +
+      '<label class="generic-field-label">Drop capabilities</label>' +
+      '<input class="generic-field-content task-editor-drop-caps" type="checkbox"></div>' +
+
+      '<div class="field task-editor-capabilities-field">' +
+      '<label class="input-field-label">Keep capabilities</label>' +
+      '<input class="input-field-input task-editor-capabilities" ' +
+      'placeholder="e.g. CAP_NET_BIND_SERVICE"></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Seccomp</label>' +
+      '<select class="input-field-input task-editor-seccomp">' +
+      '<option value="">None</option><option value="default">Default</option>' +
+      '</select></div>' +
+
+      '<div class="field">' +
+      '<label class="input-field-label">Proxy host</label>' +
+      '<input class="input-field-input task-editor-proxy-host" ' +
+      'placeholder="Optional; sets PORT"></div>' +
+
+      '<div class="field task-editor-health-type-field">' +
+      '<label class="input-field-label">Health check</label>' +
+      '<select class="input-field-input task-editor-health-type">' +
+      '<option value="">Port accepts connections</option>' +
+      '<option value="tcp">TCP</option><option value="http">HTTP</option>' +
+      '</select></div>' +
+
+      '<div class="field task-editor-health-path-field">' +
+      '<label class="input-field-label">Health check path</label>' +
+      '<input class="input-field-input task-editor-health-path"></div>' +
+
+      '<div class="field task-editor-deploy-field">' +
+      '<label class="input-field-label">When edited while running</label>' +
+      '<select class="input-field-input task-editor-deploy">' +
+      '<option value="restart">Restart</option>' +
+      '<option value="blue-green">Blue-green deploy</option></select></div>' +
+
       '</div>');
 
     this._registerFieldEvents();
@@ -130,17 +503,25 @@
   };
 
   TaskEditor.prototype._registerFieldEvents = function() {
-    var checkFields = ['auto-launch', 'auto-relaunch', 'set-gid', 'set-uid'];
+    var checkFields = ['auto-launch', 'auto-relaunch', 'set-gid', 'set-uid', 'mount-ns',
+      'drop-caps', 'terminal'];
     for (var i = 0; i < checkFields.length; ++i) {
       this._getField(checkFields[i]).change(this._updateFieldVisibility.bind(this));
     }
+    this._getField('proxy-host').on('input', this._updateFieldVisibility.bind(this));
+    this._getField('schedule').on('input', this._updateFieldVisibility.bind(this));
+    this._getField('health-type').change(this._updateFieldVisibility.bind(this));
+    this._getField('pre-stop-type').change(this._updateFieldVisibility.bind(this));
+    this._getField('inherit-env').change(this._updateFieldVisibility.bind(this));
   };
 
   TaskEditor.prototype._updateFieldVisibility = function() {
     var fields = {
       'auto-relaunch': 'relaunch-interval',
       'set-gid': 'gid',
-      'set-uid': 'uid'
+      'set-uid': 'uid',
+      'mount-ns': 'read-only',
+      'drop-caps': 'capabilities'
     };
     var keys = Object.keys(fields);
     for (var i = 0; i < keys.length; ++i) {
@@ -151,6 +532,29 @@
       }
       this._getField(fields[checkField] + '-field').css({display: display});
     }
+
+    var allowList = (this._getField('inherit-env').val() === 'allow');
+    this._getField('inherit-vars-field').css({display: allowList ? 'block' : 'none'});
+
+    var hasPreStop = (this._getField('pre-stop-type').val() !== '');
+    this._getField('pre-stop-field').css({display: hasPreStop ? 'block' : 'none'});
+
+    var hasTerminal = this._getField('terminal').is(':checked');
+    this._getField('terminal-rows-field').css({display: hasTerminal ? 'block' : 'none'});
+    this._getField('terminal-columns-field').css({display: hasTerminal ? 'block' : 'none'});
+
+    var hasMounts = this._getField('mount-ns').is(':checked');
+    this._getField('private-tmp-field').css({display: hasMounts ? 'block' : 'none'});
+
+    var hasSchedule = ($.trim(this._getField('schedule').val()) !== '');
+    this._getField('time-zone-field').css({display: hasSchedule ? 'block' : 'none'});
+    this._getField('overlap-field').css({display: hasSchedule ? 'block' : 'none'});
+
+    var hasProxy = ($.trim(this._getField('proxy-host').val()) !== '');
+    var isHTTP = (this._getField('health-type').val() === 'http');
+    this._getField('health-type-field').css({display: hasProxy ? 'block' : 'none'});
+    this._getField('deploy-field').css({display: hasProxy ? 'block' : 'none'});
+    this._getField('health-path-field').css({display: hasProxy && isHTTP ? 'block' : 'none'});
   };
 
   TaskEditor.prototype._updateFieldsFromTask = function(task) {
@@ -162,6 +566,60 @@
     this._getField('relaunch-interval').val(task.Interval);
     this._getField('gid').val(task.GID);
     this._getField('uid').val(task.UID);
+    this._getField('user').val(task.User || '');
+    this._getField('group').val(task.Group || '');
+    this._getField('inherit-env').val(task.InheritEnv || 'all');
+    this._getField('inherit-vars').val((task.InheritVars || []).join(', '));
+    this._getField('env-files').val((task.EnvFiles || []).join(', '));
+    this._getField('replicas').val(task.Replicas || 1);
+    this._getField('schedule').val(task.Schedule || '');
+    this._getField('time-zone').val(task.TimeZone || '');
+    this._getField('overlap').val(task.Overlap || 'skip');
+    this._getField('stop-signal').val(task.StopSignal || 'SIGTERM');
+    this._getField('stop-timeout').val(task.StopTimeout || '');
+    if (this._preStop.URL) {
+      this._getField('pre-stop-type').val('url');
+      this._getField('pre-stop').val(this._preStop.URL);
+    } else if (this._preStop.Command) {
+      this._getField('pre-stop-type').val('command');
+      this._getField('pre-stop').val(this._preStop.Command);
+    } else {
+      this._getField('pre-stop-type').val('');
+    }
+
+    var resources = (task.Resources || {});
+    var optional = function(value) {
+      return (value === null || value === undefined ? '' : value);
+    };
+    this._getField('memory-max').val(resources.MemoryMax ? resources.MemoryMax / 1048576 : '');
+    this._getField('cpu-max').val(resources.CPUMax || '');
+    this._getField('pids-max').val(resources.PidsMax || '');
+    this._getField('open-files').val(optional(resources.OpenFiles));
+    this._getField('processes').val(optional(resources.Processes));
+    this._getField('core-size').val(optional(resources.CoreSize));
+    this._getField('cpu-time').val(optional(resources.CPUTime));
+    this._getField('pre-start').val((task.PreStart || []).join('\n'));
+    this._getField('post-start').val((task.PostStart || []).join('\n'));
+    this._getField('post-stop').val((task.PostStop || []).join('\n'));
+    this._getField('hook-timeout').val(task.HookTimeout || '');
+    this._getField('terminal').attr('checked', !!task.Terminal);
+    this._getField('terminal-rows').val((task.Terminal || {}).Rows || '');
+    this._getField('terminal-columns').val((task.Terminal || {}).Columns || '');
+    var sandbox = (task.Sandbox || {});
+    this._getField('mount-ns').attr('checked', !!sandbox.MountNamespace);
+    this._getField('read-only').val((sandbox.ReadOnlyPaths || []).join(', '));
+    this._getField('private-tmp').attr('checked', !!sandbox.PrivateTmp);
+    this._getField('pid-ns').attr('checked', !!sandbox.PIDNamespace);
+    this._getField('ipc-ns').attr('checked', !!sandbox.IPCNamespace);
+    this._getField('no-new-privs').attr('checked', !!sandbox.NoNewPrivs);
+    this._getField('drop-caps').attr('checked', !!sandbox.DropCapabilities);
+    this._getField('capabilities').val((sandbox.Capabilities || []).join(', '));
+    this._getField('seccomp').val(sandbox.Seccomp || '');
+    this._getField('proxy-host').val(this._proxy.Host || '');
+    var check = (this._proxy.HealthCheck || {});
+    this._getField('health-type').val(check.Type || '');
+    this._getField('health-path').val(check.Path || '');
+    this._getField('deploy').val(this._proxy.Deploy || 'restart');
     this._updateFieldVisibility();
   };
 
@@ -186,6 +644,36 @@
     return $res;
   }
 
+  function createDependencyElement(dep) {
+    var $res = $('<div class="task-editor-dependency"><select class="task-editor-dep-task">' +
+      '</select><select class="task-editor-dep-condition">' +
+      '<option value="started">Started</option><option value="healthy">Healthy</option>' +
+      '</select><input class="task-editor-dep-address" placeholder="host:port to check">' +
+      '<button>Remove</button></div>');
+    var $task = $res.find('.task-editor-dep-task');
+    var choices = (window.taskChoices || []);
+    for (var i = 0; i < choices.length; ++i) {
+      $task.append($('<option></option>').val(choices[i].ID).text(choices[i].Label));
+    }
+    if (dep.Task) {
+      $task.val(dep.Task);
+    }
+    var $condition = $res.find('.task-editor-dep-condition');
+    var $address = $res.find('.task-editor-dep-address');
+    $condition.val(dep.Condition || 'started');
+    $address.val(dep.Address || '');
+    var updateAddress = function() {
+      $address.css({display: $condition.val() === 'healthy' ? 'inline-block' : 'none'});
+    };
+    $condition.change(updateAddress);
+    updateAddress();
+    $res.data('dependency', dep);
+    $res.find('button').click(function() {
+      $res.remove();
+    });
+    return $res;
+  }
+
   window.TaskEditor = TaskEditor;
 
 })();
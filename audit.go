@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const MaxAuditEntries = 1000
+
+// AuditLog records actions from the control panel which run code on the host.
+var AuditLog = &auditLog{}
+
+// An AuditEntry records one action from the control panel.
+type AuditEntry struct {
+	// ID identifies the entry, so that its result can be recorded once the action finishes.
+	ID int64
+
+	// Time is the UNIX timestamp in milliseconds when the action started.
+	Time int64
+
+	ClientIP string
+	Action   string
+	Task     int64
+	Command  string
+
+	// Result describes the outcome, such as "exit status 0" or "timed out". It is empty while
+	// the action is running.
+	Result string
+}
+
+// An auditLog keeps recent entries in memory and writes every entry to goule's log. If it has
+// been opened, entries are also appended to a file, so that they survive a restart.
+type auditLog struct {
+	lock    sync.Mutex
+	entries []*AuditEntry
+	lastID  int64
+	file    *os.File
+}
+
+// Open loads the entries saved in a file and appends new entries to it. Each line of the file
+// is an entry in JSON, and a later line for an entry replaces the earlier ones. Entries which
+// never finished are marked as interrupted. The file is rewritten with only the recent entries.
+func (a *auditLog) Open(path string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	entries, err := readAuditFile(path)
+	if err != nil {
+		return err
+	}
+	if len(entries) > MaxAuditEntries {
+		entries = entries[len(entries)-MaxAuditEntries:]
+	}
+	for _, entry := range entries {
+		if entry.Result == "" {
+			entry.Result = "interrupted by a restart"
+		}
+		if entry.ID > a.lastID {
+			a.lastID = entry.ID
+		}
+	}
+
+	tempPath := path + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := writeAuditEntry(file, entry); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		file.Close()
+		return err
+	}
+	a.entries = entries
+	a.file = file
+	return nil
+}
+
+// Start records an action which has started, setting the entry's ID and time. Finish should be
+// called with the ID when the action is over.
+func (a *auditLog) Start(entry AuditEntry) int64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.lastID++
+	entry.ID = a.lastID
+	entry.Time = time.Now().UnixNano() / 1000000
+	log.Print("Audit: " + entry.ClientIP + " started " + entry.Action + " on task " +
+		strconv.FormatInt(entry.Task, 10) + ": " + strconv.Quote(entry.Command))
+
+	a.entries = append(a.entries, &entry)
+	if len(a.entries) > MaxAuditEntries {
+		a.entries = append([]*AuditEntry{}, a.entries[len(a.entries)-MaxAuditEntries:]...)
+	}
+	a.save(&entry)
+	return entry.ID
+}
+
+// Finish records the result of an action started with Start.
+func (a *auditLog) Finish(id int64, result string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, entry := range a.entries {
+		if entry.ID == id {
+			entry.Result = result
+			log.Print("Audit: " + entry.ClientIP + " finished " + entry.Action + " on task " +
+				strconv.FormatInt(entry.Task, 10) + ": " + strconv.Quote(entry.Command) + " (" +
+				result + ")")
+			a.save(entry)
+			return
+		}
+	}
+}
+
+// TaskEntries returns the entries for a task, oldest first.
+func (a *auditLog) TaskEntries(id int64) []AuditEntry {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	res := []AuditEntry{}
+	for _, entry := range a.entries {
+		if entry.Task == id {
+			res = append(res, *entry)
+		}
+	}
+	return res
+}
+
+func (a *auditLog) save(entry *AuditEntry) {
+	if a.file == nil {
+		return
+	}
+	if err := writeAuditEntry(a.file, entry); err != nil {
+		log.Print("Failed to save audit entry: " + err.Error())
+	}
+}
+
+func readAuditFile(path string) ([]*AuditEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var res []*AuditEntry
+	indices := map[int64]int{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A line may have been cut short by a crash.
+			continue
+		}
+		if i, ok := indices[entry.ID]; ok {
+			res[i] = &entry
+		} else {
+			indices[entry.ID] = len(res)
+			res = append(res, &entry)
+		}
+	}
+	return res, scanner.Err()
+}
+
+func writeAuditEntry(file *os.File, entry *AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
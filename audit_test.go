@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goule-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json.audit")
+
+	first := &auditLog{}
+	if err := first.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	id := first.Start(AuditEntry{Action: "run_command", Task: 1, Command: "make migrate"})
+	if entries := first.TaskEntries(1); len(entries) != 1 || entries[0].Result != "" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	first.Finish(id, "exit status 0")
+	first.Start(AuditEntry{Action: "run_command", Task: 1, Command: "sleep 1000"})
+	first.Start(AuditEntry{Action: "run_command", Task: 2, Command: "true"})
+	first.file.Close()
+
+	second := &auditLog{}
+	if err := second.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer second.file.Close()
+	entries := second.TaskEntries(1)
+	if len(entries) != 2 || entries[0].Command != "make migrate" ||
+		entries[0].Result != "exit status 0" || entries[1].Result != "interrupted by a restart" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	if id := second.Start(AuditEntry{Task: 3}); id != 4 {
+		t.Errorf("expected ID 4 but got %d", id)
+	}
+}
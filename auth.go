@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	AuthBasic   = "basic"
+	AuthSession = "session"
+)
+
+// sessionCookieName is the name of the control panel's session cookie.
+const sessionCookieName = "sessid"
+
+// ProxyAuth requires clients to authenticate before their requests are forwarded.
+type ProxyAuth struct {
+	// Type is either AuthBasic or AuthSession.
+	//
+	// With AuthBasic, clients must provide one of the Users' credentials with HTTP basic auth.
+	//
+	// With AuthSession, clients must be logged in to the control panel. Clients who are not are
+	// redirected to LoginURL. For the session cookie to reach other hosts, the control panel's
+	// SessionDomain must be set to a domain which contains them.
+	Type string
+
+	// Realm is the realm sent to clients for basic auth.
+	Realm string
+
+	// Users maps usernames to password hashes (as produced by HashPassword) for basic auth.
+	Users map[string]string
+
+	// LoginURL is the absolute URL of the control panel's login page for session auth.
+	LoginURL string
+
+	// NewPasswords maps usernames to plaintext passwords submitted by the control panel.
+	// HashPasswords moves them into Users, so they are never saved.
+	NewPasswords map[string]string `json:",omitempty"`
+}
+
+// Copy returns a deep copy of the ProxyAuth.
+func (p *ProxyAuth) Copy() *ProxyAuth {
+	res := *p
+	res.Users = map[string]string{}
+	for user, hash := range p.Users {
+		res.Users[user] = hash
+	}
+	return &res
+}
+
+// HashPasswords hashes NewPasswords into Users and clears NewPasswords.
+func (p *ProxyAuth) HashPasswords() {
+	if p.Users == nil {
+		p.Users = map[string]string{}
+	}
+	for user, password := range p.NewPasswords {
+		p.Users[user] = HashPassword(password)
+	}
+	p.NewPasswords = nil
+}
+
+// Validate returns an error if the ProxyAuth is invalid.
+func (p *ProxyAuth) Validate() error {
+	switch p.Type {
+	case AuthBasic:
+		if len(p.Users) == 0 {
+			return errors.New("basic auth requires at least one user")
+		}
+	case AuthSession:
+		u, err := url.Parse(p.LoginURL)
+		if err != nil || u.Host == "" {
+			return errors.New("session auth requires an absolute login URL")
+		}
+	default:
+		return errors.New("invalid auth type: " + p.Type)
+	}
+	return nil
+}
+
+// Authenticate checks a request's credentials.
+// If the request is not authenticated, this responds to it and returns false.
+// Otherwise, the credentials are removed so that they are not forwarded to the target.
+func (p *ProxyAuth) Authenticate(w http.ResponseWriter, r *http.Request) bool {
+	if p.Type == AuthSession {
+		if isAuthenticated(r) {
+			removeCookie(r, sessionCookieName)
+			return true
+		}
+		loginURL, _ := url.Parse(p.LoginURL)
+		query := loginURL.Query()
+		query.Set("next", requestScheme(r)+"://"+r.Host+r.URL.RequestURI())
+		loginURL.RawQuery = query.Encode()
+		http.Redirect(w, r, loginURL.String(), http.StatusTemporaryRedirect)
+		return false
+	}
+
+	if user, password, ok := r.BasicAuth(); ok {
+		if hash, ok := p.Users[user]; ok {
+			if subtle.ConstantTimeCompare([]byte(hash), []byte(HashPassword(password))) == 1 {
+				r.Header.Del("Authorization")
+				return true
+			}
+		}
+	}
+	realm := p.Realm
+	if realm == "" {
+		realm = "goule"
+	}
+	w.Header().Set("WWW-Authenticate", "Basic realm=\""+strings.Replace(realm, "\"", "", -1)+
+		"\"")
+	http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+	return false
+}
+
+// removeCookie deletes a cookie from a request's Cookie headers.
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
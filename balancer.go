@@ -0,0 +1,211 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	BalanceRandom     = "random"
+	BalanceRoundRobin = "round-robin"
+	BalanceLeastConn  = "least-conn"
+	BalanceIPHash     = "ip-hash"
+	BalanceCookieHash = "cookie-hash"
+)
+
+// hashReplicas is the number of points each unit of weight gets on a consistent hash ring.
+const hashReplicas = 100
+
+// A balancer chooses which target should handle a request.
+type balancer interface {
+	// Pick selects one of the candidate targets, all of which are known to be healthy.
+	// The candidates list is never empty.
+	Pick(r *http.Request, candidates []*Target) *Target
+}
+
+// newBalancer creates the balancer for a route.
+// The active map gives the number of in-flight requests for each target host.
+func newBalancer(route *Route, active map[string]*int64) balancer {
+	switch route.Balance {
+	case BalanceRoundRobin:
+		return &roundRobinBalancer{current: map[string]int{}}
+	case BalanceLeastConn:
+		return leastConnBalancer{active}
+	case BalanceIPHash:
+		return newHashBalancer(route.Targets, "")
+	case BalanceCookieHash:
+		return newHashBalancer(route.Targets, route.HashCookie)
+	default:
+		return randomBalancer{}
+	}
+}
+
+// randomBalancer picks targets at random in proportion to their weights.
+type randomBalancer struct{}
+
+func (randomBalancer) Pick(r *http.Request, candidates []*Target) *Target {
+	total := 0
+	for _, target := range candidates {
+		total += target.weight()
+	}
+	n := rand.Intn(total)
+	for _, target := range candidates {
+		n -= target.weight()
+		if n < 0 {
+			return target
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// roundRobinBalancer cycles through targets using smooth weighted round-robin, so heavier
+// targets are picked more often without receiving their requests in bursts.
+type roundRobinBalancer struct {
+	lock    sync.Mutex
+	current map[string]int
+}
+
+func (b *roundRobinBalancer) Pick(r *http.Request, candidates []*Target) *Target {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	total := 0
+	var best *Target
+	for _, target := range candidates {
+		total += target.weight()
+		b.current[target.Host] += target.weight()
+		if best == nil || b.current[target.Host] > b.current[best.Host] {
+			best = target
+		}
+	}
+	b.current[best.Host] -= total
+	return best
+}
+
+// retain forgets the state of hosts which are not among a new list of targets, so that the
+// balancer does not grow as targets come and go.
+func (b *roundRobinBalancer) retain(targets []*Target) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	hosts := map[string]bool{}
+	for _, target := range targets {
+		hosts[target.Host] = true
+	}
+	for host := range b.current {
+		if !hosts[host] {
+			delete(b.current, host)
+		}
+	}
+}
+
+// leastConnBalancer picks the target with the fewest in-flight requests relative to its weight.
+type leastConnBalancer struct {
+	active map[string]*int64
+}
+
+func (b leastConnBalancer) Pick(r *http.Request, candidates []*Target) *Target {
+	var best *Target
+	var bestCount int64
+	ties := 0
+	for _, target := range candidates {
+		var count int64
+		if counter, ok := b.active[target.Host]; ok {
+			count = atomic.LoadInt64(counter)
+		}
+		if best != nil {
+			// Compare count/weight against bestCount/bestWeight without division.
+			lhs := count * int64(best.weight())
+			rhs := bestCount * int64(target.weight())
+			if lhs > rhs {
+				continue
+			} else if lhs == rhs {
+				// Break ties uniformly at random.
+				ties++
+				if rand.Intn(ties+1) != 0 {
+					continue
+				}
+			} else {
+				ties = 0
+			}
+		}
+		best = target
+		bestCount = count
+	}
+	return best
+}
+
+// hashBalancer maps clients onto a consistent hash ring, so a given client keeps reaching the
+// same target as long as that target is healthy.
+type hashBalancer struct {
+	cookie string
+	points []uint32
+	hosts  map[uint32]string
+}
+
+func newHashBalancer(targets []*Target, cookie string) *hashBalancer {
+	res := &hashBalancer{cookie: cookie, hosts: map[uint32]string{}}
+	for _, target := range targets {
+		for i := 0; i < target.weight()*hashReplicas; i++ {
+			point := hashString(target.Host + "#" + strconv.Itoa(i))
+			if _, ok := res.hosts[point]; ok {
+				continue
+			}
+			res.hosts[point] = target.Host
+			res.points = append(res.points, point)
+		}
+	}
+	sort.Slice(res.points, func(i, j int) bool {
+		return res.points[i] < res.points[j]
+	})
+	return res
+}
+
+func (b *hashBalancer) Pick(r *http.Request, candidates []*Target) *Target {
+	byHost := map[string]*Target{}
+	for _, target := range candidates {
+		byHost[target.Host] = target
+	}
+
+	point := hashString(b.key(r))
+	start := sort.Search(len(b.points), func(i int) bool {
+		return b.points[i] >= point
+	})
+	for i := 0; i < len(b.points); i++ {
+		host := b.hosts[b.points[(start+i)%len(b.points)]]
+		if target, ok := byHost[host]; ok {
+			return target
+		}
+	}
+
+	// Only reached if the candidates are not in the ring.
+	return candidates[0]
+}
+
+// key returns the value which is hashed to pick a target for a request.
+// If the cookie is not present, the client's IP address is used instead.
+func (b *hashBalancer) key(r *http.Request) string {
+	if b.cookie != "" {
+		if cookie, err := r.Cookie(b.cookie); err == nil {
+			return cookie.Value
+		}
+	}
+	return remoteIP(r)
+}
+
+// hashString hashes a string onto the ring. FNV alone spreads similar strings, such as the
+// addresses in a subnet, poorly, so its result is mixed with MurmurHash3's finalizer.
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
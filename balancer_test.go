@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func testTargets(weights ...int) []*Target {
+	res := make([]*Target, len(weights))
+	for i, weight := range weights {
+		res[i] = &Target{Host: "10.0.0." + strconv.Itoa(i+1) + ":80", Weight: weight}
+	}
+	return res
+}
+
+func pickCounts(b balancer, r *http.Request, targets []*Target, n int) map[string]int {
+	res := map[string]int{}
+	for i := 0; i < n; i++ {
+		res[b.Pick(r, targets).Host]++
+	}
+	return res
+}
+
+func TestWeightedBalancers(t *testing.T) {
+	tests := []struct {
+		balance   string
+		weights   []int
+		picks     int
+		expected  []int
+		tolerance int
+	}{
+		{BalanceRoundRobin, []int{1, 1, 1}, 9, []int{3, 3, 3}, 0},
+		{BalanceRoundRobin, []int{5, 1, 1}, 14, []int{10, 2, 2}, 0},
+		{BalanceRoundRobin, []int{0, 2}, 6, []int{2, 4}, 0},
+		{BalanceRandom, []int{1, 1}, 10000, []int{5000, 5000}, 500},
+		{BalanceRandom, []int{3, 1}, 10000, []int{7500, 2500}, 500},
+	}
+	for _, test := range tests {
+		targets := testTargets(test.weights...)
+		route := &Route{Targets: targets, Balance: test.balance}
+		b := newBalancer(route, map[string]*int64{})
+		counts := pickCounts(b, httptest.NewRequest("GET", "/", nil), targets, test.picks)
+		for i, target := range targets {
+			diff := counts[target.Host] - test.expected[i]
+			if diff < -test.tolerance || diff > test.tolerance {
+				t.Errorf("%s %v: expected about %v picks but got %v", test.balance,
+					test.weights, test.expected, counts)
+				break
+			}
+		}
+	}
+}
+
+func TestRoundRobinSmooth(t *testing.T) {
+	targets := testTargets(5, 1, 1)
+	b := newBalancer(&Route{Targets: targets, Balance: BalanceRoundRobin}, nil)
+	var sequence []int
+	for i := 0; i < 7; i++ {
+		picked := b.Pick(nil, targets)
+		for j, target := range targets {
+			if target == picked {
+				sequence = append(sequence, j)
+			}
+		}
+	}
+	expected := []int{0, 0, 1, 0, 2, 0, 0}
+	for i := range expected {
+		if sequence[i] != expected[i] {
+			t.Fatalf("expected %v but got %v", expected, sequence)
+		}
+	}
+}
+
+func TestRoundRobinRetain(t *testing.T) {
+	b := &roundRobinBalancer{current: map[string]int{}}
+	for i := 0; i < 10; i++ {
+		b.Pick(nil, testTargets(1, 1, 1))
+	}
+	targets := testTargets(1)
+	b.retain(targets)
+	if len(b.current) != 1 || b.Pick(nil, targets) != targets[0] {
+		t.Errorf("unexpected state: %v", b.current)
+	}
+}
+
+func TestLeastConnBalancer(t *testing.T) {
+	tests := []struct {
+		weights  []int
+		active   []int64
+		expected int
+	}{
+		{[]int{1, 1, 1}, []int64{2, 0, 1}, 1},
+		{[]int{1, 1, 1}, []int64{3, 2, 1}, 2},
+		{[]int{4, 1}, []int64{2, 1}, 0},
+		{[]int{1, 4}, []int64{1, 5}, 0},
+	}
+	for _, test := range tests {
+		targets := testTargets(test.weights...)
+		active := map[string]*int64{}
+		for i, target := range targets {
+			count := test.active[i]
+			active[target.Host] = &count
+		}
+		b := newBalancer(&Route{Targets: targets, Balance: BalanceLeastConn}, active)
+		if picked := b.Pick(nil, targets); picked != targets[test.expected] {
+			t.Errorf("%v %v: expected %s but got %s", test.weights, test.active,
+				targets[test.expected].Host, picked.Host)
+		}
+	}
+}
+
+func TestHashBalancers(t *testing.T) {
+	targets := testTargets(1, 1, 1, 1)
+	tests := []struct {
+		route *Route
+		vary  func(r *http.Request, i int)
+	}{
+		{&Route{Targets: targets, Balance: BalanceIPHash}, func(r *http.Request, i int) {
+			r.RemoteAddr = "192.168.1." + strconv.Itoa(i) + ":1234"
+		}},
+		{&Route{Targets: targets, Balance: BalanceCookieHash, HashCookie: "session"},
+			func(r *http.Request, i int) {
+				r.AddCookie(&http.Cookie{Name: "session", Value: strconv.Itoa(i)})
+			}},
+	}
+	for _, test := range tests {
+		b := newBalancer(test.route, nil)
+		used := map[*Target]bool{}
+		for i := 0; i < 100; i++ {
+			r := httptest.NewRequest("GET", "/", nil)
+			test.vary(r, i)
+			picked := b.Pick(r, targets)
+			used[picked] = true
+			if b.Pick(r, targets) != picked {
+				t.Fatalf("%s: client %d moved between picks", test.route.Balance, i)
+			}
+
+			// Only the clients of a missing target move.
+			var others []*Target
+			for _, target := range targets {
+				if target != picked {
+					others = append(others, target)
+				}
+			}
+			if b.Pick(r, others) == picked {
+				t.Fatalf("%s: picked a target which is not a candidate", test.route.Balance)
+			}
+			if len(others) > 0 && b.Pick(r, append(others, picked)) != picked {
+				t.Fatalf("%s: client %d moved when the candidates were reordered",
+					test.route.Balance, i)
+			}
+		}
+		if len(used) != len(targets) {
+			t.Errorf("%s: only %d of %d targets were used", test.route.Balance, len(used),
+				len(targets))
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cgroupMount is where the cgroup v2 hierarchy is mounted.
+const cgroupMount = "/sys/fs/cgroup"
+
+// cpuMaxPeriod is the period in microseconds used for cpu.max.
+const cpuMaxPeriod = 100000
+
+// clockTicks is USER_HZ, the number of clock ticks per second in which /proc reports CPU times.
+const clockTicks = 100
+
+// TaskCgroups creates the cgroups in which tasks run.
+var TaskCgroups = &cgroupManager{}
+
+// A cgroupManager creates a cgroup for each task inside goule's own cgroup.
+// Goule's cgroup must be delegated to it, as with systemd's Delegate=yes.
+type cgroupManager struct {
+	// Enabled must be set before any cgroups are created, since goule's own cgroup is
+	// reorganized when the first one is.
+	Enabled bool
+
+	once sync.Once
+	base string
+	err  error
+
+	lock sync.Mutex
+	next int
+}
+
+// Create makes a new cgroup for a task and applies the task's limits to it.
+func (c *cgroupManager) Create(id int64, limits *ResourceLimits) (string, error) {
+	if !c.Enabled {
+		return "", errors.New("cgroups are disabled (see ManageCgroups in the configuration)")
+	}
+	c.once.Do(func() {
+		c.base, c.err = setupCgroups()
+		if c.err != nil {
+			log.Print("Tasks will not run in cgroups: " + c.err.Error())
+		}
+	})
+	if c.err != nil {
+		return "", c.err
+	}
+
+	c.lock.Lock()
+	c.next++
+	name := "task-" + strconv.FormatInt(id, 10) + "-" + strconv.Itoa(c.next)
+	c.lock.Unlock()
+
+	dir := filepath.Join(c.base, name)
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	if limits == nil {
+		return dir, nil
+	}
+	var settings [][2]string
+	if limits.MemoryMax != 0 {
+		settings = append(settings, [2]string{"memory.max",
+			strconv.FormatInt(limits.MemoryMax, 10)})
+	}
+	if limits.CPUMax != 0 {
+		quota := int64(limits.CPUMax * cpuMaxPeriod)
+		if quota < 1000 {
+			quota = 1000
+		}
+		settings = append(settings, [2]string{"cpu.max",
+			strconv.FormatInt(quota, 10) + " " + strconv.Itoa(cpuMaxPeriod)})
+	}
+	if limits.PidsMax != 0 {
+		settings = append(settings, [2]string{"pids.max",
+			strconv.FormatInt(limits.PidsMax, 10)})
+	}
+	for _, setting := range settings {
+		err := ioutil.WriteFile(filepath.Join(dir, setting[0]), []byte(setting[1]), 0644)
+		if err != nil {
+			os.Remove(dir)
+			return "", errors.New("setting " + setting[0] + ": " + err.Error())
+		}
+	}
+	return dir, nil
+}
+
+// setupCgroups finds goule's cgroup and enables the controllers for task cgroups in it.
+// A cgroup whose controllers are enabled for its children cannot contain processes itself, so
+// the processes in goule's cgroup are moved into a "goule" child.
+func setupCgroups() (string, error) {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	var ownPath string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			ownPath = line[3:]
+		}
+	}
+	if ownPath == "" {
+		return "", errors.New("cgroup v2 is not available")
+	}
+	base := filepath.Join(cgroupMount, ownPath)
+	controllers, err := ioutil.ReadFile(filepath.Join(base, "cgroup.controllers"))
+	if err != nil {
+		return "", errors.New("cgroup v2 is not mounted at " + cgroupMount)
+	}
+
+	if ownPath != "/" {
+		leaf := filepath.Join(base, "goule")
+		if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+		procs, err := ioutil.ReadFile(filepath.Join(base, "cgroup.procs"))
+		if err != nil {
+			return "", err
+		}
+		for _, pid := range strings.Fields(string(procs)) {
+			// Processes may exit while they are being moved.
+			ioutil.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(pid), 0644)
+		}
+	}
+
+	available := strings.Fields(string(controllers))
+	for _, name := range []string{"memory", "cpu", "pids"} {
+		found := false
+		for _, controller := range available {
+			found = found || controller == name
+		}
+		if !found {
+			continue
+		}
+		path := filepath.Join(base, "cgroup.subtree_control")
+		if err := ioutil.WriteFile(path, []byte("+"+name), 0644); err != nil {
+			return "", errors.New("enabling " + name + " controller: " + err.Error())
+		}
+	}
+	return base, nil
+}
+
+// joinCgroup moves a process into a cgroup.
+func joinCgroup(dir string, pid int) error {
+	return ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
+// setupCgroup creates a cgroup for the task if it has limits which need one. If the cgroup
+// cannot be created, the error is logged to the backlog and the task runs without the limits.
+func (t *Task) setupCgroup() {
+	if !t.Resources.usesCgroup() {
+		return
+	}
+	dir, err := TaskCgroups.Create(t.ID, t.Resources)
+	if err != nil {
+		t.pushBacklog(BacklogLineStatus, "Cannot apply memory, CPU, or process limits: "+
+			err.Error()+".")
+		return
+	}
+	t.cgroupLock.Lock()
+	t.cgroup = dir
+	t.cgroupLock.Unlock()
+}
+
+// removeCgroup removes the task's cgroup once its processes have exited.
+func (t *Task) removeCgroup() {
+	t.cgroupLock.Lock()
+	defer t.cgroupLock.Unlock()
+	if t.cgroup != "" {
+		os.Remove(t.cgroup)
+		t.cgroup = ""
+	}
+}
+
+func (t *Task) cgroupDir() string {
+	t.cgroupLock.Lock()
+	defer t.cgroupLock.Unlock()
+	return t.cgroup
+}
+
+// setProcessGroup records the process group of a replica's command while it runs. A pgid of 0
+// means that the command has exited.
+func (t *Task) setProcessGroup(replica, pgid int) {
+	t.cgroupLock.Lock()
+	defer t.cgroupLock.Unlock()
+	if pgid == 0 {
+		delete(t.processGroups, replica)
+		return
+	}
+	if t.processGroups == nil {
+		t.processGroups = map[int]int{}
+	}
+	t.processGroups[replica] = pgid
+}
+
+// ResourceUsage returns the memory in bytes used by the task's processes and the percentage of
+// one CPU which they have used since the last call. The usage of the task's cgroup is used if
+// it has one, and otherwise that of the processes in its replicas' process groups. If the task
+// has no cgroup and is not running, errTaskNotRunning is returned.
+func (t *Task) ResourceUsage() (memory int64, cpu float64, err error) {
+	t.cgroupLock.Lock()
+	defer t.cgroupLock.Unlock()
+	var usage int64
+	if t.cgroup != "" {
+		memory, usage, err = cgroupUsage(t.cgroup)
+	} else if len(t.processGroups) > 0 {
+		pgids := map[int]bool{}
+		for _, pgid := range t.processGroups {
+			pgids[pgid] = true
+		}
+		memory, usage, err = processGroupUsage(pgids)
+	} else {
+		err = errTaskNotRunning
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	now := time.Now()
+	if !t.cpuSampleTime.IsZero() {
+		elapsed := now.Sub(t.cpuSampleTime)
+		if elapsed > 0 && usage >= t.cpuSampleUsage {
+			used := time.Duration(usage-t.cpuSampleUsage) * time.Microsecond
+			t.cpuPercent = 100 * float64(used) / float64(elapsed)
+		}
+	}
+	t.cpuSampleTime = now
+	t.cpuSampleUsage = usage
+	return memory, t.cpuPercent, nil
+}
+
+// cgroupUsage returns the memory in bytes and CPU time in microseconds used by a cgroup.
+func cgroupUsage(dir string) (memory, usage int64, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "memory.current"))
+	if err != nil {
+		return 0, 0, errors.New("cannot read cgroup memory usage")
+	}
+	memory, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return 0, 0, errors.New("cannot read cgroup CPU usage")
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			usage, _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return memory, usage, nil
+}
+
+// processGroupUsage returns the resident memory in bytes and CPU time in microseconds used by
+// the processes in some process groups. Processes which have left the groups are not counted.
+func processGroupUsage(pgids map[int]bool) (memory, usage int64, err error) {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0, 0, errors.New("cannot read /proc")
+	}
+	pageSize := int64(os.Getpagesize())
+	for _, dir := range dirs {
+		if _, err := strconv.Atoi(dir.Name()); err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join("/proc", dir.Name(), "stat"))
+		if err != nil {
+			// The process may have exited.
+			continue
+		}
+
+		// The fields after the command name, which may contain spaces, start with the third.
+		end := strings.LastIndexByte(string(data), ')')
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(string(data[end+1:]))
+		if len(fields) < 22 {
+			continue
+		}
+		if pgid, _ := strconv.Atoi(fields[2]); !pgids[pgid] {
+			continue
+		}
+		utime, _ := strconv.ParseInt(fields[11], 10, 64)
+		stime, _ := strconv.ParseInt(fields[12], 10, 64)
+		rss, _ := strconv.ParseInt(fields[21], 10, 64)
+		usage += (utime + stime) * (1000000 / clockTicks)
+		memory += rss * pageSize
+	}
+	return memory, usage, nil
+}
+
+// usageLabel describes the memory and CPU used by a task for the task list.
+// It returns "" if the task is not running.
+func usageLabel(t *Task) string {
+	memory, cpu, err := t.ResourceUsage()
+	if err == errTaskNotRunning {
+		return ""
+	} else if err != nil {
+		return "Usage: n/a (" + err.Error() + ")"
+	}
+	megabytes := float64(memory) / (1 << 20)
+	return "Memory: " + strconv.FormatFloat(megabytes, 'f', 1, 64) + " MB · CPU: " +
+		strconv.FormatFloat(cpu, 'f', 0, 64) + "%"
+}
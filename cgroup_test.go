@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestProcessGroupUsage(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	task := &Task{}
+	if label := usageLabel(task); label != "" {
+		t.Errorf("unexpected label for a stopped task: %q", label)
+	}
+	task.setProcessGroup(0, cmd.Process.Pid)
+
+	// The process may not have joined its group yet.
+	var memory int64
+	for i := 0; i < 100 && memory == 0; i++ {
+		var err error
+		if memory, _, err = task.ResourceUsage(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if memory <= 0 {
+		t.Errorf("unexpected memory usage: %d", memory)
+	}
+	if label := usageLabel(task); !strings.HasPrefix(label, "Memory: ") {
+		t.Errorf("unexpected label: %q", label)
+	}
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"net"
 	"os"
+	"strconv"
 	"sync"
 
 	"github.com/unixpickle/ezserver"
-	"github.com/unixpickle/reverseproxy"
 )
 
 type TLSConfig struct {
@@ -21,13 +23,33 @@ type Config struct {
 	HTTPPort   int
 	HTTPSPort  int
 	AdminHash  string
-	Rules      reverseproxy.RuleTable
+	Rules      RuleTable
 	StartHTTP  bool
 	StartHTTPS bool
 	Tasks      []*Task
 	TLS        *TLSConfig
+	AccessLog  AccessLogConfig
 	LastTaskID int64
-	path       string
+
+	// TrustedProxies lists the proxies whose X-Forwarded-For headers are believed.
+	TrustedProxies []string
+
+	// ControlAccess restricts which clients may use the control panel.
+	ControlAccess IPFilter
+
+	// SessionDomain, if non-empty, is the domain of the control panel's session cookie. Setting
+	// it lets proxy rules with session auth recognize logged-in clients on other subdomains.
+	SessionDomain string
+
+	// ManageCgroups lets goule create cgroups for tasks with memory, CPU, or process limits.
+	// Goule's cgroup must be delegated to it, and goule moves its own processes into a child
+	// cgroup the first time such a task starts.
+	ManageCgroups bool
+
+	path string
+
+	// trustedNets holds the parsed TrustedProxies once the configuration has been validated.
+	trustedNets []*net.IPNet
 }
 
 // LoadConfig reads a configuration from a JSON file and returns the result.
@@ -46,10 +68,38 @@ func LoadConfig(path string) (*Config, error) {
 	if err := json.Unmarshal(contents, &res); err != nil {
 		return nil, err
 	}
+	if err := res.Validate(); err != nil {
+		return nil, err
+	}
 	res.path = path
 	return &res, nil
 }
 
+// Validate returns an error if the configuration is invalid.
+// It also parses the trusted proxies and control panel IPFilter, so the Config should be locked.
+func (c *Config) Validate() error {
+	if err := c.Rules.Validate(); err != nil {
+		return err
+	}
+	for _, task := range c.Tasks {
+		if err := task.Validate(); err != nil {
+			return errors.New("task " + strconv.FormatInt(task.ID, 10) + ": " + err.Error())
+		}
+	}
+	if err := validateDependencies(c.Tasks); err != nil {
+		return err
+	}
+	if err := c.AccessLog.Validate(); err != nil {
+		return err
+	}
+	trustedNets, err := parseNetworks(c.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	c.trustedNets = trustedNets
+	return c.ControlAccess.Validate()
+}
+
 // Save writes the configuration to its file.
 // The Config should be locked (a read-only lock is sufficient).
 func (c *Config) Save() error {
@@ -73,6 +123,6 @@ func defaultConfig(path string) *Config {
 
 	hash := HashPassword("password")
 
-	return &Config{Rules: reverseproxy.RuleTable{}, Tasks: []*Task{},
+	return &Config{Rules: RuleTable{}, Tasks: []*Task{},
 		AdminHash: hash, TLS: &tls, path: path}
 }
@@ -4,18 +4,22 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log"
 	"mime"
 	"net/http"
 	"net/url"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/hoisie/mustache"
+	"golang.org/x/net/websocket"
 )
 
 var Store = sessions.NewCookieStore(securecookie.GenerateRandomKey(16),
@@ -30,19 +34,35 @@ type Control struct {
 // ServeAddTask serves the add-task page.
 func (c Control) ServeAddTask(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		serveTemplate(w, r, "add_task", map[string]interface{}{})
+		c.Config.RLock()
+		choices := c.taskChoices(0)
+		c.Config.RUnlock()
+		serveTemplate(w, r, "add_task", map[string]interface{}{"taskChoices": choices})
 		return
 	}
 	taskJSON := r.PostFormValue("task")
 	task := &Task{}
-	if err := json.Unmarshal([]byte(taskJSON), task); err != nil {
-		serveTemplate(w, r, "add_task", map[string]interface{}{"error": err.Error()})
-		return
+	err := json.Unmarshal([]byte(taskJSON), task)
+	if err == nil {
+		err = task.Validate()
+	}
+	if err == nil {
+		err = task.validateAccount()
 	}
 
 	c.Config.Lock()
+	if err == nil {
+		task.ID = c.Config.LastTaskID + 1
+		err = validateDependencies(append([]*Task{task}, c.Config.Tasks...))
+	}
+	if err != nil {
+		choices := c.taskChoices(0)
+		c.Config.Unlock()
+		serveTemplate(w, r, "add_task", map[string]interface{}{"error": err.Error(),
+			"taskChoices": choices})
+		return
+	}
 	c.Config.LastTaskID++
-	task.ID = c.Config.LastTaskID
 	c.Config.Tasks = append([]*Task{task}, c.Config.Tasks...)
 	task.StartLoop()
 	if task.AutoRun {
@@ -54,6 +74,44 @@ func (c Control) ServeAddTask(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
 
+// ServeAccessLog serves the page which shows recent proxy requests and configures the access log.
+func (c Control) ServeAccessLog(w http.ResponseWriter, r *http.Request) {
+	template := map[string]interface{}{}
+	if r.Method == http.MethodPost {
+		config := AccessLogConfig{
+			Format: r.PostFormValue("format"),
+			Path:   r.PostFormValue("path"),
+		}
+		config.MaxSize, _ = strconv.Atoi(r.PostFormValue("maxsize"))
+		config.MaxFiles, _ = strconv.Atoi(r.PostFormValue("maxfiles"))
+		if err := config.Validate(); err != nil {
+			template["error"] = err.Error()
+		} else {
+			c.Config.Lock()
+			c.Config.AccessLog = config
+			c.Config.Save()
+			c.Config.Unlock()
+			c.Server.Proxy.AccessLog().SetConfig(config)
+		}
+	}
+
+	logger := c.Server.Proxy.AccessLog()
+	config := logger.Config()
+	template["path"] = config.Path
+	template["maxSize"] = config.MaxSize
+	template["maxFiles"] = config.MaxFiles
+	template["json"] = config.Format == AccessLogJSON
+
+	data, err := json.Marshal(logger.Recent())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	template["entries"] = string(data)
+
+	serveTemplate(w, r, "access_log", template)
+}
+
 // ServeAsset serves a static asset.
 func (c Control) ServeAsset(w http.ResponseWriter, r *http.Request) {
 	urlPath := path.Clean(r.URL.Path)
@@ -91,7 +149,8 @@ func (c Control) ServeBacklog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	serveTemplate(w, r, "backlog", map[string]interface{}{"backlog": string(data)})
+	serveTemplate(w, r, "backlog", map[string]interface{}{"backlog": string(data),
+		"replicas": task.replicaCount() > 1})
 }
 
 // ServeChpass serves the change password POST target.
@@ -121,6 +180,98 @@ func (c Control) ServeChpass(w http.ResponseWriter, r *http.Request) {
 		http.StatusTemporaryRedirect)
 }
 
+// ServeConsole serves the interactive console page of a task.
+func (c Control) ServeConsole(w http.ResponseWriter, r *http.Request) {
+	c.Config.RLock()
+	defer c.Config.RUnlock()
+	task, replica, err := c.consoleTask(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var replicas []map[string]interface{}
+	if task.replicaCount() > 1 {
+		for i := 0; i < task.replicaCount(); i++ {
+			replicas = append(replicas, map[string]interface{}{"index": i,
+				"selected": i == replica})
+		}
+	}
+	rows, columns := task.Terminal.size()
+	serveTemplate(w, r, "console", map[string]interface{}{
+		"id":          strconv.FormatInt(task.ID, 10),
+		"replica":     replica,
+		"replicas":    replicas,
+		"hasReplicas": len(replicas) > 0,
+		"args":        strings.Join(task.Args, " "),
+		"rows":        rows,
+		"columns":     columns,
+	})
+}
+
+// maxConsoleMessage is the largest message which a console may send.
+const maxConsoleMessage = 1 << 20
+
+// ServeConsoleSocket serves the WebSocket behind the console page. Terminal output is sent in
+// binary messages. The client sends JSON objects with Input to type into the terminal or Signal
+// to signal the task, and errors are sent back as JSON objects in text messages.
+func (c Control) ServeConsoleSocket(w http.ResponseWriter, r *http.Request) {
+	c.Config.RLock()
+	task, replica, err := c.consoleTask(r)
+	c.Config.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The Origin of the handshake has already been checked by validateReferer.
+	websocket.Server{Handler: func(socket *websocket.Conn) {
+		socket.MaxPayloadBytes = maxConsoleMessage
+		c.serveConsoleSocket(socket, task, replica)
+	}}.ServeHTTP(w, r)
+}
+
+func (c Control) serveConsoleSocket(socket *websocket.Conn, task *Task, replica int) {
+	scrollback, output, cancel := task.watchTerminal(replica)
+	defer cancel()
+	if len(scrollback) > 0 {
+		websocket.Message.Send(socket, scrollback)
+	}
+	go func() {
+		for data := range output {
+			if websocket.Message.Send(socket, data) != nil {
+				break
+			}
+		}
+		socket.Close()
+	}()
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(socket, &data); err == websocket.ErrFrameTooLarge {
+			continue
+		} else if err != nil {
+			return
+		}
+		var message struct {
+			Input  string
+			Signal string
+		}
+		if err := json.Unmarshal(data, &message); err != nil {
+			continue
+		}
+		var err error
+		if message.Input != "" {
+			err = task.WriteTerminal(replica, []byte(message.Input))
+		} else if message.Signal != "" {
+			err = c.signalConsoleTask(task, message.Signal)
+		}
+		if err != nil {
+			websocket.JSON.Send(socket, map[string]string{"error": err.Error()})
+		}
+	}
+}
+
 // ServeDeleteTask serves the task deletion page.
 func (c Control) ServeDeleteTask(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
@@ -135,11 +286,19 @@ func (c Control) ServeDeleteTask(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid task ID", http.StatusBadRequest)
 		return
 	}
-	task.StopLoop()
-	for i := index; i < len(c.Config.Tasks)-1; i++ {
-		c.Config.Tasks[i] = c.Config.Tasks[i+1]
+	if task.deployment != nil {
+		http.Error(w, "The task is being deployed.", http.StatusConflict)
+		return
+	}
+	remaining := make([]*Task, 0, len(c.Config.Tasks)-1)
+	remaining = append(remaining, c.Config.Tasks[:index]...)
+	remaining = append(remaining, c.Config.Tasks[index+1:]...)
+	if err := validateDependencies(remaining); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
 	}
-	c.Config.Tasks = c.Config.Tasks[0 : len(c.Config.Tasks)-1]
+	task.StopLoop()
+	c.Config.Tasks = remaining
 	c.Config.Save()
 
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -157,29 +316,39 @@ func (c Control) ServeEditTask(w http.ResponseWriter, r *http.Request) {
 		c.Config.Lock()
 		defer c.Config.Unlock()
 
-		_, task := c.findTaskById(id)
+		index, task := c.findTaskById(id)
 		if task == nil {
 			http.Error(w, "Invalid task ID", http.StatusBadRequest)
 			return
 		}
 
-		oldStatus := task.Status()
-		oldEnv := task.Env
-		task.Env = nil
-		task.StopLoop()
-		if err := json.Unmarshal([]byte(r.PostFormValue("task")), task); err != nil {
+		if task.deployment != nil {
+			http.Error(w, "The task is being deployed.", http.StatusConflict)
+			return
+		}
+		next, err := updatedTask(task, []byte(r.PostFormValue("task")))
+		if err == nil {
+			tasks := append([]*Task{}, c.Config.Tasks...)
+			tasks[index] = next
+			err = validateDependencies(tasks)
+		}
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
-			task.Env = oldEnv
-			task.StartLoop()
-			if oldStatus != TaskStatusStopped {
-				task.Start()
-			}
 			return
 		}
-		c.Config.Save()
-		task.StartLoop()
-		if oldStatus != TaskStatusStopped {
-			task.Start()
+
+		oldStatus := task.Status()
+		if oldStatus != TaskStatusStopped && usesBlueGreen(task, next) {
+			startDeploy(c.Config, task, next)
+		} else {
+			task.StopLoop()
+			next.inheritBacklog(task)
+			c.Config.Tasks[index] = next
+			c.Config.Save()
+			next.StartLoop()
+			if oldStatus != TaskStatusStopped {
+				next.Start()
+			}
 		}
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
@@ -200,7 +369,8 @@ func (c Control) ServeEditTask(w http.ResponseWriter, r *http.Request) {
 	}
 
 	serveTemplate(w, r, "edit_task", map[string]interface{}{"taskData": string(data),
-		"id": strconv.FormatInt(id, 10)})
+		"id": strconv.FormatInt(id, 10), "taskChoices": c.taskChoices(id),
+		"terminal": task.Terminal != nil})
 }
 
 // ServeGeneral serves requests for the general settings page.
@@ -211,13 +381,25 @@ func (c Control) ServeGeneral(w http.ResponseWriter, r *http.Request) {
 		httpsPort := r.PostFormValue("https")
 		startHTTP := r.PostFormValue("starthttp")
 		startHTTPS := r.PostFormValue("starthttps")
+		trusted := splitList(r.PostFormValue("trusted"))
+		access := IPFilter{Allow: splitList(r.PostFormValue("allow")),
+			Deny: splitList(r.PostFormValue("deny"))}
+		sessionDomain := strings.TrimSpace(r.PostFormValue("sessiondomain"))
 		c.Config.Lock()
+		if err := setControlAccess(c.Config, r, trusted, access); err != nil {
+			c.Config.Unlock()
+			http.Redirect(w, r, "/general?accessError="+url.QueryEscape(err.Error()),
+				http.StatusTemporaryRedirect)
+			return
+		}
 		c.Config.HTTPPort, _ = strconv.Atoi(httpPort)
 		c.Config.HTTPSPort, _ = strconv.Atoi(httpsPort)
 		c.Config.StartHTTP = (startHTTP == "On")
 		c.Config.StartHTTPS = (startHTTPS == "On")
+		c.Config.SessionDomain = sessionDomain
 		c.Config.Save()
 		c.Config.Unlock()
+		c.Server.Proxy.SetTrustedProxies(trusted)
 	}
 
 	template := map[string]interface{}{}
@@ -228,6 +410,10 @@ func (c Control) ServeGeneral(w http.ResponseWriter, r *http.Request) {
 	template["https"] = c.Config.HTTPSPort
 	template["startHTTP"] = c.Config.StartHTTP
 	template["startHTTPS"] = c.Config.StartHTTPS
+	template["trusted"] = strings.Join(c.Config.TrustedProxies, ", ")
+	template["allow"] = strings.Join(c.Config.ControlAccess.Allow, ", ")
+	template["deny"] = strings.Join(c.Config.ControlAccess.Deny, ", ")
+	template["sessionDomain"] = c.Config.SessionDomain
 	c.Config.RUnlock()
 
 	template["httpRunning"], template["httpPort"] = c.Server.HTTP.Status()
@@ -239,12 +425,19 @@ func (c Control) ServeGeneral(w http.ResponseWriter, r *http.Request) {
 	} else if msg := query.Get("success"); msg != "" {
 		template["chpassSuccess"] = msg
 	}
+	if errMsg := query.Get("accessError"); errMsg != "" {
+		template["accessError"] = errMsg
+	}
 
 	serveTemplate(w, r, "general", template)
 }
 
 // ServeHTTP serves the web control panel.
 func (c Control) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !c.allowClient(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 	if !validateReferer(r) {
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
@@ -270,7 +463,10 @@ func (c Control) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"/setrules": c.ServeSetRules, "/add_task": c.ServeAddTask,
 		"/start_task": c.ServeStartTask, "/stop_task": c.ServeStopTask,
 		"/edit_task": c.ServeEditTask, "/backlog": c.ServeBacklog,
-		"/delete_task": c.ServeDeleteTask, "/set_tls": c.ServeSetTLS}
+		"/delete_task": c.ServeDeleteTask, "/set_tls": c.ServeSetTLS,
+		"/access_log": c.ServeAccessLog, "/maintenance": c.ServeMaintenance,
+		"/signal_task": c.ServeSignalTask, "/console": c.ServeConsole,
+		"/console_socket": c.ServeConsoleSocket, "/run_command": c.ServeRunCommand}
 	handler, ok := pages[urlPath]
 	if !ok {
 		handler = http.NotFound
@@ -319,21 +515,30 @@ func (c Control) ServeHTTPSConfig(w http.ResponseWriter, r *http.Request) {
 }
 
 // ServeLogin serves the login page.
+// If the "next" parameter is a safe destination, the client is sent there after logging in.
 func (c Control) ServeLogin(w http.ResponseWriter, r *http.Request) {
-	template := map[string]interface{}{"error": false}
+	next := r.FormValue("next")
+	if !c.safeNext(next) {
+		next = "/"
+	}
+	template := map[string]interface{}{"error": false, "next": next}
 	if r.Method == http.MethodPost {
 		// Get their submitted hash and the real hash.
 		password := r.PostFormValue("password")
 		hash := HashPassword(password)
 		c.Config.RLock()
 		realHash := c.Config.AdminHash
+		sessionDomain := c.Config.SessionDomain
 		c.Config.RUnlock()
 		// Check if they got the password correct.
 		if hash == realHash {
-			s, _ := Store.Get(r, "sessid")
+			s, _ := Store.Get(r, sessionCookieName)
 			s.Values["authenticated"] = true
+			// Each session has its own copy of the Store's options, which are shared by every
+			// request and must not be changed.
+			s.Options.Domain = sessionDomain
 			s.Save(r, w)
-			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+			http.Redirect(w, r, next, http.StatusSeeOther)
 			return
 		}
 		template["error"] = true
@@ -349,6 +554,39 @@ func (c Control) ServeLogin(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(content))
 }
 
+// ServeMaintenance provides a basic link-driven API for turning a host's maintenance mode on and
+// off. The host is the key of its rule in the rule table.
+func (c Control) ServeMaintenance(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var enabled bool
+	switch query.Get("action") {
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	default:
+		http.Error(w, "Invalid action.", http.StatusBadRequest)
+		return
+	}
+
+	host := query.Get("host")
+	c.Config.Lock()
+	defer c.Config.Unlock()
+	rule, ok := c.Config.Rules[host]
+	if !ok {
+		http.Error(w, "Invalid host.", http.StatusBadRequest)
+		return
+	}
+	if rule.Maintenance == nil {
+		rule.Maintenance = &Maintenance{}
+	}
+	rule.Maintenance.Enabled = enabled
+	c.Config.Save()
+	c.Server.Proxy.SetMaintenance(host, enabled)
+
+	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+}
+
 // ServeRoot serves the homepage (task list).
 func (c Control) ServeRoot(w http.ResponseWriter, r *http.Request) {
 	template := map[string]interface{}{}
@@ -360,10 +598,36 @@ func (c Control) ServeRoot(w http.ResponseWriter, r *http.Request) {
 		action := []string{"start", "stop", "stop"}[status]
 		actionName := []string{"Start", "Stop", "Restarting"}[status]
 		args := "[" + filepath.Base(task.Dir) + "] " + strings.Join(task.Args, " ")
+		if replicas := task.replicaCount(); replicas > 1 {
+			args += " (" + strconv.Itoa(replicas) + " replicas)"
+		}
+		if task.deployment != nil {
+			actionName = "Deploying"
+		}
 		objects[i] = map[string]string{"action": action, "status": statusStr, "args": args,
-			"actionName": actionName, "id": strconv.FormatInt(task.ID, 10)}
+			"actionName": actionName, "id": strconv.FormatInt(task.ID, 10),
+			"schedule": scheduleLabel(task), "usage": usageLabel(task)}
 	}
 	template["tasks"] = objects
+
+	hosts := make([]string, 0, len(c.Config.Rules))
+	for host := range c.Config.Rules {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	maintenance := make([]map[string]interface{}, len(hosts))
+	for i, host := range hosts {
+		m := c.Config.Rules[host].Maintenance
+		enabled := m != nil && m.Enabled
+		action, actionName := "on", "Enable"
+		if enabled {
+			action, actionName = "off", "Disable"
+		}
+		maintenance[i] = map[string]interface{}{"host": host, "query": url.QueryEscape(host),
+			"enabled": enabled, "action": action, "actionName": actionName}
+	}
+	template["maintenance"] = maintenance
+	template["hasMaintenance"] = len(maintenance) > 0
 	c.Config.RUnlock()
 
 	serveTemplate(w, r, "tasks", template)
@@ -379,18 +643,95 @@ func (c Control) ServeRules(w http.ResponseWriter, r *http.Request) {
 	c.Config.RUnlock()
 	template["rules"] = string(encoded)
 
+	// Encode the health of each target and the rejection counts so the page can display them.
+	health, _ := json.Marshal(c.Server.Proxy.Health())
+	template["health"] = string(health)
+	stats, _ := json.Marshal(c.Server.Proxy.LimitStats())
+	template["stats"] = string(stats)
+
 	serveTemplate(w, r, "rules", template)
 }
 
+// ServeRunCommand serves the page for running a one-off command in a task's context.
+// A POST runs the shell command in the "command" form value and streams its output as plain
+// text, so the page can also be used as an API. The "timeout" form value is in seconds.
+func (c Control) ServeRunCommand(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Config.RLock()
+	_, task := c.findTaskById(id)
+	trusted := c.Config.trustedNets
+	c.Config.RUnlock()
+	if task == nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		history, _ := json.Marshal(AuditLog.TaskEntries(id))
+		serveTemplate(w, r, "run_command", map[string]interface{}{
+			"id":      strconv.FormatInt(id, 10),
+			"args":    strings.Join(task.Args, " "),
+			"timeout": defaultRunTimeout,
+			"history": string(history),
+		})
+		return
+	}
+
+	command := r.PostFormValue("command")
+	if strings.TrimSpace(command) == "" {
+		http.Error(w, "Missing command", http.StatusBadRequest)
+		return
+	}
+	timeout := defaultRunTimeout
+	if value := r.PostFormValue("timeout"); value != "" {
+		timeout, err = strconv.Atoi(value)
+		if err != nil || timeout < 1 || timeout > maxRunTimeout {
+			http.Error(w, "Timeout must be between 1 and "+strconv.Itoa(maxRunTimeout)+
+				" seconds", http.StatusBadRequest)
+			return
+		}
+	}
+
+	auditID := AuditLog.Start(AuditEntry{
+		ClientIP: clientIP(r, trusted),
+		Action:   "run_command",
+		Task:     id,
+		Command:  command,
+	})
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	output := &flushWriter{w: w}
+	err = task.RunCommand(command, time.Second*time.Duration(timeout), output,
+		r.Context().Done())
+	result := "exit status 0"
+	if err == errCommandTimedOut {
+		result = "timed out after " + strconv.Itoa(timeout) + "s"
+	} else if err != nil {
+		result = err.Error()
+	}
+	output.Write([]byte("\n[" + result + "]\n"))
+	AuditLog.Finish(auditID, result)
+}
+
 // ServeSetRules serves requests for the page that sets the rules.
 func (c Control) ServeSetRules(w http.ResponseWriter, r *http.Request) {
 	// Get rules from the request.
 	rulesData := r.PostFormValue("rules")
-	var decoded map[string][]string
+	var decoded RuleTable
 	if err := json.Unmarshal([]byte(rulesData), &decoded); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	decoded.HashPasswords()
+	if err := decoded.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Set rules in the configuration and server.
 	c.Config.Lock()
@@ -443,6 +784,35 @@ func (c Control) ServeTLS(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ServeSignalTask sends a signal, given by name or number, to a running task.
+func (c Control) ServeSignalTask(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sig, err := parseSignal(query.Get("signal"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.Config.RLock()
+	defer c.Config.RUnlock()
+	_, task := c.findTaskById(id)
+	if task == nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+	if err := task.Signal(sig); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	http.Redirect(w, r, "/backlog?id="+strconv.FormatInt(id, 10), http.StatusTemporaryRedirect)
+}
+
 // ServeTaskAction serves the start_task and stop_task pages.
 func (c Control) ServeTaskAction(w http.ResponseWriter, r *http.Request, start bool) {
 	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
@@ -451,14 +821,20 @@ func (c Control) ServeTaskAction(w http.ResponseWriter, r *http.Request, start b
 		return
 	}
 
-	c.Config.Lock()
-	defer c.Config.Unlock()
+	// A read lock lets the task list load while a task takes a while to stop.
+	c.Config.RLock()
+	defer c.Config.RUnlock()
 	_, task := c.findTaskById(id)
 	if task == nil {
 		http.Error(w, "Invalid task ID", http.StatusBadRequest)
 		return
 	}
 
+	if task.deployment != nil {
+		http.Error(w, "The task is being deployed.", http.StatusConflict)
+		return
+	}
+
 	if start {
 		task.Start()
 	} else {
@@ -468,6 +844,80 @@ func (c Control) ServeTaskAction(w http.ResponseWriter, r *http.Request, start b
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
 
+// allowClient checks a request's client address against the control panel's IPFilter.
+func (c Control) allowClient(r *http.Request) bool {
+	c.Config.RLock()
+	defer c.Config.RUnlock()
+	return c.Config.ControlAccess.Allows(clientIP(r, c.Config.trustedNets))
+}
+
+// safeNext returns whether a post-login destination is a path on the control panel or a page on
+// a host which uses session auth, so that the login page cannot be used as an open redirect.
+func (c Control) safeNext(next string) bool {
+	if strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") {
+		return true
+	}
+	u, err := url.Parse(next)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return c.Server.Proxy.UsesSessionAuth(u.Host)
+}
+
+// taskChoices returns a JSON list of the tasks which a task may depend on, excluding the task with
+// the given ID. The Config should be locked (a read-only lock is sufficient).
+func (c Control) taskChoices(exclude int64) string {
+	choices := []map[string]interface{}{}
+	for _, task := range c.Config.Tasks {
+		if task.ID == exclude {
+			continue
+		}
+		label := "[" + filepath.Base(task.Dir) + "] " + strings.Join(task.Args, " ")
+		choices = append(choices, map[string]interface{}{"ID": task.ID, "Label": label})
+	}
+	data, _ := json.Marshal(choices)
+	return string(data)
+}
+
+// consoleTask finds the task and replica for a console request.
+// The caller must hold the Config's lock.
+func (c Control) consoleTask(r *http.Request) (*Task, int, error) {
+	query := r.URL.Query()
+	id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, task := c.findTaskById(id)
+	if task == nil {
+		return nil, 0, errors.New("Invalid task ID")
+	} else if task.Terminal == nil {
+		return nil, 0, errors.New("The task does not use a terminal.")
+	}
+	replica := 0
+	if query.Get("replica") != "" {
+		replica, err = strconv.Atoi(query.Get("replica"))
+		if err != nil || replica < 0 || replica >= task.replicaCount() {
+			return nil, 0, errors.New("Invalid replica")
+		}
+	}
+	return task, replica, nil
+}
+
+// signalConsoleTask sends a signal from a console to its task, unless the task has since been
+// replaced or deleted.
+func (c Control) signalConsoleTask(task *Task, name string) error {
+	sig, err := parseSignal(name)
+	if err != nil {
+		return err
+	}
+	c.Config.RLock()
+	defer c.Config.RUnlock()
+	if _, current := c.findTaskById(task.ID); current != task {
+		return errors.New("the task has been changed; reload the console")
+	}
+	return task.Signal(sig)
+}
+
 func (c Control) findTaskById(id int64) (index int, task *Task) {
 	for i, t := range c.Config.Tasks {
 		if t.ID == id {
@@ -483,9 +933,29 @@ func HashPassword(password string) string {
 	return strings.ToLower(hex.EncodeToString(hash[:]))
 }
 
+// setControlAccess updates the trusted proxies and control panel IPFilter.
+// It refuses changes which are invalid or which would lock out the client making the request.
+// The Config should be locked.
+func setControlAccess(cfg *Config, r *http.Request, trusted []string, access IPFilter) error {
+	trustedNets, err := parseNetworks(trusted)
+	if err != nil {
+		return err
+	}
+	if err := access.Validate(); err != nil {
+		return err
+	}
+	if !access.Allows(clientIP(r, trustedNets)) {
+		return errors.New("the new settings would block your own address")
+	}
+	cfg.TrustedProxies = trusted
+	cfg.trustedNets = trustedNets
+	cfg.ControlAccess = access
+	return nil
+}
+
 // isAuthenticated returns whether or not a request was authenticated.
 func isAuthenticated(r *http.Request) bool {
-	s, _ := Store.Get(r, "sessid")
+	s, _ := Store.Get(r, sessionCookieName)
 	val, ok := s.Values["authenticated"].(bool)
 	return ok && val
 }
@@ -512,6 +982,17 @@ func serveTemplate(w http.ResponseWriter, r *http.Request, name string, info int
 	w.Write([]byte(content))
 }
 
+// splitList splits a comma-separated list, discarding empty entries.
+func splitList(list string) []string {
+	res := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
 // validateReferer makes sure the Referer's host is correct for a request.
 func validateReferer(r *http.Request) bool {
 	urlPath := path.Clean(r.URL.Path)
@@ -520,13 +1001,18 @@ func validateReferer(r *http.Request) bool {
 	}
 	if r.Method == http.MethodGet {
 		allowedGets := []string{"/general", "/rules", "/tls", "/", "/backlog", "/edit_task",
-			"/add_task", "/login"}
+			"/add_task", "/login", "/access_log", "/console", "/run_command"}
 		for _, path := range allowedGets {
 			if path == urlPath {
 				return true
 			}
 		}
 	}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		// Browsers send an Origin instead of a Referer with WebSocket handshakes.
+		u, err := url.Parse(r.Header.Get("Origin"))
+		return err == nil && u.Host == originalHost(r)
+	}
 	// Get the Referer
 	referer := r.Referer()
 	u, err := url.Parse(referer)
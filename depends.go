@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	DependStarted = "started"
+	DependHealthy = "healthy"
+)
+
+// defaultDependencyTimeout is the number of seconds a task waits for a dependency at startup if
+// the dependency does not set a timeout.
+const defaultDependencyTimeout = 60
+
+// dependencyPollInterval is how often a task checks its dependencies while it waits for them.
+const dependencyPollInterval = time.Second / 2
+
+// A Dependency makes a task wait for another task when goule starts.
+type Dependency struct {
+	// Task is the ID of the task which must be ready first.
+	Task int64
+
+	// Condition is DependStarted or DependHealthy. The empty string is equivalent to
+	// DependStarted.
+	Condition string
+
+	// Address is a "host:port" which must accept TCP connections for the task to be healthy.
+	// If it is empty, the task must be linked to a proxy host, and it is healthy once every
+	// replica passes the proxy's health check.
+	Address string
+
+	// Timeout is the number of seconds to wait before starting the dependent task anyway.
+	// If it is 0, defaultDependencyTimeout is used.
+	Timeout int
+}
+
+// Validate returns an error if the Dependency is invalid on its own.
+// The tasks it refers to are checked by validateDependencies.
+func (d *Dependency) Validate() error {
+	switch d.Condition {
+	case "", DependStarted, DependHealthy:
+	default:
+		return errors.New("invalid dependency condition: " + d.Condition)
+	}
+	if d.Timeout < 0 {
+		return errors.New("dependency timeout must not be negative")
+	}
+	return nil
+}
+
+// validateDependencies returns an error if a task in a list depends on a task which is not in the
+// list or which cannot report its health, or if the dependencies form a cycle.
+func validateDependencies(tasks []*Task) error {
+	_, err := dependencyOrder(tasks)
+	return err
+}
+
+// dependencyOrder sorts tasks so that every task comes after the tasks it depends on.
+// Tasks are otherwise kept in order. If the dependencies are invalid, it returns the tasks in their
+// original order along with an error.
+func dependencyOrder(tasks []*Task) ([]*Task, error) {
+	byID := map[int64]*Task{}
+	for _, task := range tasks {
+		byID[task.ID] = task
+	}
+
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := map[*Task]int{}
+	res := make([]*Task, 0, len(tasks))
+	var path []*Task
+
+	var visit func(task *Task) error
+	visit = func(task *Task) error {
+		switch state[task] {
+		case visited:
+			return nil
+		case visiting:
+			cycle := "task " + strconv.FormatInt(task.ID, 10)
+			for i := len(path) - 1; i >= 0 && path[i] != task; i-- {
+				cycle = "task " + strconv.FormatInt(path[i].ID, 10) + " -> " + cycle
+			}
+			return errors.New("dependency cycle: task " + strconv.FormatInt(task.ID, 10) +
+				" -> " + cycle)
+		}
+		state[task] = visiting
+		path = append(path, task)
+		for _, dep := range task.DependsOn {
+			other := byID[dep.Task]
+			if other == nil {
+				return errors.New("task " + strconv.FormatInt(task.ID, 10) +
+					" depends on missing task " + strconv.FormatInt(dep.Task, 10))
+			}
+			if dep.Condition == DependHealthy && dep.Address == "" && other.Proxy == nil {
+				return errors.New("task " + strconv.FormatInt(task.ID, 10) +
+					" needs an address to check the health of task " +
+					strconv.FormatInt(dep.Task, 10))
+			}
+			if err := visit(other); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[task] = visited
+		res = append(res, task)
+		return nil
+	}
+
+	for _, task := range tasks {
+		if err := visit(task); err != nil {
+			return tasks, err
+		}
+	}
+	return res, nil
+}
+
+// startTasks starts the loops of a list of tasks and starts the AutoRun tasks, each after the
+// tasks it depends on are ready.
+func startTasks(tasks []*Task) {
+	order, err := dependencyOrder(tasks)
+	if err != nil {
+		log.Print("Ignoring task dependencies: " + err.Error())
+	}
+	byID := map[int64]*Task{}
+	for _, task := range order {
+		byID[task.ID] = task
+		task.StartLoop()
+	}
+	for _, task := range order {
+		if !task.AutoRun {
+			continue
+		}
+		for _, dep := range task.DependsOn {
+			if other := byID[dep.Task]; other != nil {
+				task.waitForDependency(other, dep)
+			}
+		}
+		task.Start()
+	}
+}
+
+// waitForDependency waits for a task to meet the condition of a dependency on it, logging to the
+// backlog if it does not. A stopped task which is not auto-launched is not waited for.
+func (t *Task) waitForDependency(other *Task, dep Dependency) {
+	id := strconv.FormatInt(other.ID, 10)
+	if !other.AutoRun && other.Status() == TaskStatusStopped {
+		t.pushBacklog(BacklogLineStatus, "Dependency task "+id+" is not auto-launched.")
+		return
+	}
+	timeout := dep.Timeout
+	if timeout == 0 {
+		timeout = defaultDependencyTimeout
+	}
+	deadline := time.Now().Add(time.Second * time.Duration(timeout))
+	for !dep.isMet(other) {
+		if !time.Now().Before(deadline) {
+			t.pushBacklog(BacklogLineStatus, "Dependency task "+id+" was not "+
+				dep.conditionName()+" after "+strconv.Itoa(timeout)+" seconds; starting anyway.")
+			return
+		}
+		time.Sleep(dependencyPollInterval)
+	}
+}
+
+func (d Dependency) isMet(task *Task) bool {
+	if task.Status() != TaskStatusRunning {
+		return false
+	}
+	if d.Condition != DependHealthy {
+		return true
+	}
+	if d.Address == "" {
+		return task.isHealthy()
+	}
+	check := HealthCheck{Type: "tcp", Timeout: 1}.withDefaults()
+	return probeTarget(check, d.Address) == nil
+}
+
+func (d Dependency) conditionName() string {
+	if d.Condition == "" {
+		return DependStarted
+	}
+	return d.Condition
+}
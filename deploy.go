@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	DeployRestart   = "restart"
+	DeployBlueGreen = "blue-green"
+)
+
+const (
+	defaultDeployTimeout = 60
+	defaultDrainTime     = 10
+)
+
+// deployPollInterval is how often a deploy checks the health of the new version.
+const deployPollInterval = time.Second / 10
+
+// updatedTask returns a copy of a task with the changes from a JSON object applied.
+// Fields missing from the object keep their values, except for Env and Proxy, which are replaced.
+// The copy has no running loop.
+func updatedTask(task *Task, data []byte) (*Task, error) {
+	current, err := json.Marshal(task)
+	if err != nil {
+		return nil, err
+	}
+	res := NewTask()
+	if err := json.Unmarshal(current, res); err != nil {
+		return nil, err
+	}
+	res.Env = nil
+	res.Proxy = nil
+	if err := json.Unmarshal(data, res); err != nil {
+		return nil, err
+	}
+	res.ID = task.ID
+	if err := res.Validate(); err != nil {
+		return nil, err
+	}
+	if err := res.validateAccount(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// usesBlueGreen returns whether replacing a running task with a new version should use a
+// blue-green deploy.
+func usesBlueGreen(old, next *Task) bool {
+	return old.Proxy != nil && next.Proxy != nil && next.Proxy.Deploy == DeployBlueGreen
+}
+
+// startDeploy begins replacing a running task with a new version without downtime.
+// The new version is started on a fresh port. Once it passes its health check, the proxy sends
+// requests to it instead of the old version, which is stopped after DrainTime. If the new
+// version does not pass its health check within DeployTimeout, or fails it while the old version
+// is draining, it is stopped and the old version keeps serving.
+//
+// The Config should be locked. The old task is replaced in cfg.Tasks when the deploy completes.
+func startDeploy(cfg *Config, old, next *Task) {
+	next.inheritBacklog(old)
+	old.pushBacklog(BacklogLineStatus, "Deploying new version.")
+	old.deployment = next
+	next.StartLoop()
+	next.Start()
+	go finishDeploy(cfg, old, next)
+}
+
+func finishDeploy(cfg *Config, old, next *Task) {
+	timeout := time.Second * time.Duration(next.Proxy.DeployTimeout)
+	if timeout == 0 {
+		timeout = time.Second * defaultDeployTimeout
+	}
+	drain := time.Second * time.Duration(next.Proxy.DrainTime)
+	if drain == 0 {
+		drain = time.Second * defaultDrainTime
+	}
+
+	healthy := waitForHealth(next, timeout)
+	if healthy {
+		// The new version has replaced the old version's targets in TaskTargets, except for
+		// those of replicas which it does not have.
+		old.setProxyRetired(true)
+		old.pushBacklog(BacklogLineStatus, "Switched proxy to new version; draining.")
+		healthy = stayHealthy(next, drain)
+	}
+
+	cfg.Lock()
+	defer cfg.Unlock()
+	if old.deployment != next {
+		// The server shut down during the deploy.
+		return
+	}
+	old.deployment = nil
+	if !healthy {
+		// The old version is registered again before the new version stops, so the host
+		// always has a target.
+		next.setProxyRetired(true)
+		old.setProxyRetired(false)
+		next.StopLoop()
+		old.pushBacklog(BacklogLineStatus, "New version failed its health check; rolled back.")
+		return
+	}
+	for i, task := range cfg.Tasks {
+		if task == old {
+			cfg.Tasks[i] = next
+		}
+	}
+	cfg.Save()
+	old.StopLoop()
+	next.pushBacklog(BacklogLineStatus, "Deployed new version.")
+}
+
+// waitForHealth waits for every replica of a task to pass its health check.
+// It returns false if the timeout elapses or the task stops first.
+func waitForHealth(task *Task, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if task.isHealthy() {
+			return true
+		}
+		if task.Status() == TaskStatusStopped {
+			return false
+		}
+		time.Sleep(deployPollInterval)
+	}
+	return false
+}
+
+// stayHealthy waits for a duration and returns false if a replica of the task fails its health
+// check or the task stops in the meantime.
+func stayHealthy(task *Task, duration time.Duration) bool {
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		if !task.isHealthy() || task.Status() == TaskStatusStopped {
+			return false
+		}
+		time.Sleep(deployPollInterval)
+	}
+	return true
+}
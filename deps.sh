@@ -1,7 +1,7 @@
 #!/bin/bash
 
 go get github.com/unixpickle/ezserver
-go get github.com/unixpickle/reverseproxy
+go get golang.org/x/net
 go get github.com/hoisie/mustache
 go get github.com/gorilla/securecookie
 go get github.com/gorilla/sessions
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// These are the ways in which a task inherits goule's environment.
+const (
+	InheritAll   = "all"
+	InheritNone  = "none"
+	InheritAllow = "allow"
+)
+
+// validateEnv returns an error if the task's environment settings are invalid.
+func (t *Task) validateEnv() error {
+	switch t.InheritEnv {
+	case "", InheritAll, InheritNone, InheritAllow:
+	default:
+		return errors.New("invalid environment inheritance: " + t.InheritEnv)
+	}
+	for _, name := range t.InheritVars {
+		if name == "" || strings.ContainsAny(name, "= ") {
+			return errors.New("invalid variable name: " + name)
+		}
+	}
+	for _, path := range t.EnvFiles {
+		if path == "" {
+			return errors.New("missing environment file path")
+		}
+	}
+	return nil
+}
+
+// environment builds the environment for the task's commands. The variables come from goule's
+// environment, the user's variables, the task's environment files in order, and the task's Env,
+// with later sources overriding earlier ones.
+func (t *Task) environment(userEnv []string) ([]string, error) {
+	vars := map[string]string{}
+	var names []string
+	set := func(name, value string) {
+		if _, ok := vars[name]; !ok {
+			names = append(names, name)
+		}
+		vars[name] = value
+	}
+
+	allowed := map[string]bool{}
+	for _, name := range t.InheritVars {
+		allowed[name] = true
+	}
+	if t.InheritEnv != InheritNone {
+		for _, entry := range os.Environ() {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) == 2 && (t.InheritEnv != InheritAllow || allowed[parts[0]]) {
+				set(parts[0], parts[1])
+			}
+		}
+	}
+	for _, entry := range userEnv {
+		parts := strings.SplitN(entry, "=", 2)
+		set(parts[0], parts[1])
+	}
+	for _, path := range t.EnvFiles {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(t.Dir, path)
+		}
+		if err := readEnvFile(path, vars, set); err != nil {
+			return nil, err
+		}
+	}
+	for key, value := range t.Env {
+		set(key, value)
+	}
+
+	res := []string{}
+	for _, name := range names {
+		res = append(res, name+"="+vars[name])
+	}
+	return res, nil
+}
+
+// readEnvFile reads a dotenv file, calling set for each variable in it. References such as $NAME
+// and ${NAME} in unquoted and double-quoted values are expanded with vars, which includes the
+// variables defined earlier in the file.
+func readEnvFile(path string, vars map[string]string, set func(name, value string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		parts := strings.SplitN(line, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" || strings.ContainsAny(name, " \t") {
+			return errors.New(path + ":" + strconv.Itoa(lineNum) + ": invalid line")
+		}
+		value, err := parseEnvValue(strings.TrimSpace(parts[1]), vars)
+		if err != nil {
+			return errors.New(path + ":" + strconv.Itoa(lineNum) + ": " + err.Error())
+		}
+		set(name, value)
+	}
+	return scanner.Err()
+}
+
+func parseEnvValue(value string, vars map[string]string) (string, error) {
+	if strings.HasPrefix(value, "'") {
+		end := strings.Index(value[1:], "'")
+		if end < 0 {
+			return "", errors.New("unterminated quote")
+		}
+		return value[1 : end+1], nil
+	}
+	if strings.HasPrefix(value, "\"") {
+		for i := 1; i < len(value); i++ {
+			switch value[i] {
+			case '"':
+				return expandEnvValue(value[1:i], vars, true), nil
+			case '\\':
+				i++
+			}
+		}
+		return "", errors.New("unterminated quote")
+	}
+	if idx := strings.Index(value, " #"); idx >= 0 {
+		value = strings.TrimSpace(value[:idx])
+	}
+	return expandEnvValue(value, vars, false), nil
+}
+
+// expandEnvValue interprets the backslash escapes in a value and replaces references such as
+// $NAME and ${NAME} with variables from vars. An escaped character, such as the "$" in "\$", is
+// kept literally. If quoted is set, "\n" and "\t" are a newline and a tab.
+func expandEnvValue(value string, vars map[string]string, quoted bool) string {
+	var res strings.Builder
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		if ch == '\\' && i+1 < len(value) {
+			i++
+			ch = value[i]
+			if quoted && ch == 'n' {
+				ch = '\n'
+			} else if quoted && ch == 't' {
+				ch = '\t'
+			}
+		} else if ch == '$' {
+			if name, length := envReference(value[i+1:]); length > 0 {
+				res.WriteString(vars[name])
+				i += length
+				continue
+			}
+		}
+		res.WriteByte(ch)
+	}
+	return res.String()
+}
+
+// envReference parses the variable reference after a "$" at the start of s, returning the name
+// and the length of the reference. The length is 0 if there is no valid reference.
+func envReference(s string) (name string, length int) {
+	if strings.HasPrefix(s, "{") {
+		end := strings.Index(s, "}")
+		if end < 2 {
+			return "", 0
+		}
+		return s[1:end], end + 1
+	}
+	for length < len(s) && (s[length] == '_' || ('a' <= s[length] && s[length] <= 'z') ||
+		('A' <= s[length] && s[length] <= 'Z') ||
+		(length > 0 && '0' <= s[length] && s[length] <= '9')) {
+		length++
+	}
+	return s[:length], length
+}
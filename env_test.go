@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseEnvValue(t *testing.T) {
+	vars := map[string]string{"HOME": "/home/app", "NAME": "goule"}
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"plain", "plain"},
+		{"two words # comment", "two words"},
+		{"a#b", "a#b"},
+		{"$HOME/data", "/home/app/data"},
+		{"${NAME}_1", "goule_1"},
+		{"$NAME_1", ""},
+		{"$MISSING-x", "-x"},
+		{"cost: $5", "cost: $5"},
+		{"${", "${"},
+		{`\$HOME`, "$HOME"},
+		{`a\\b`, `a\b`},
+		{"'$HOME \\n'", "$HOME \\n"},
+		{"'quoted' # comment", "quoted"},
+		{`"$HOME\n\tx"`, "/home/app\n\tx"},
+		{`"price \$HOME"`, "price $HOME"},
+		{`"say \"hi\""`, `say "hi"`},
+		{`"${NAME} # not a comment"`, "goule # not a comment"},
+	}
+	for _, test := range tests {
+		actual, err := parseEnvValue(test.value, vars)
+		if err != nil {
+			t.Errorf("%s: %s", test.value, err)
+		} else if actual != test.expected {
+			t.Errorf("%s: expected %q but got %q", test.value, test.expected, actual)
+		}
+	}
+	for _, value := range []string{"'open", `"open`, `"escaped\"`} {
+		if _, err := parseEnvValue(value, vars); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goule-env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".env")
+	data := "# Settings\n\nexport HOST=localhost\nPORT = 8080\nURL=\"http://$HOST:${PORT}/\"\n" +
+		"HOST=example.com\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vars := map[string]string{}
+	var names []string
+	err = readEnvFile(path, vars, func(name, value string) {
+		names = append(names, name)
+		vars[name] = value
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"HOST": "example.com", "PORT": "8080",
+		"URL": "http://localhost:8080/"}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Errorf("expected %v but got %v", expected, vars)
+	}
+	if !reflect.DeepEqual(names, []string{"HOST", "PORT", "URL", "HOST"}) {
+		t.Errorf("unexpected order: %v", names)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("VALID=1\nnot a variable\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = readEnvFile(path, map[string]string{}, func(name, value string) {})
+	if err == nil || err.Error() != path+":2: invalid line" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEnvironmentInheritance(t *testing.T) {
+	os.Setenv("GOULE_TEST_INHERIT", "yes")
+	defer os.Unsetenv("GOULE_TEST_INHERIT")
+
+	tests := []struct {
+		inherit  string
+		vars     []string
+		expected bool
+	}{
+		{"", nil, true},
+		{InheritNone, nil, false},
+		{InheritAll, nil, true},
+		{InheritAllow, []string{"GOULE_TEST_INHERIT"}, true},
+		{InheritAllow, []string{"PATH"}, false},
+	}
+	for _, test := range tests {
+		task := &Task{InheritEnv: test.inherit, InheritVars: test.vars,
+			Env: map[string]string{"OWN": "1"}}
+		env, err := task.environment(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, entry := range env {
+			found = found || entry == "GOULE_TEST_INHERIT=yes"
+		}
+		if found != test.expected {
+			t.Errorf("%q %v: expected inherited=%v but got %v", test.inherit, test.vars,
+				test.expected, env)
+		}
+		if env[len(env)-1] != "OWN=1" {
+			t.Errorf("%q: missing task variable in %v", test.inherit, env)
+		}
+	}
+}
+
+func TestLegacyTaskEnvironment(t *testing.T) {
+	var task Task
+	if err := json.Unmarshal([]byte(`{"Args": ["true"], "Dir": "/", "Env": {}}`),
+		&task); err != nil {
+		t.Fatal(err)
+	}
+	env, err := task.environment(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range env {
+		if entry == "PATH="+os.Getenv("PATH") {
+			return
+		}
+	}
+	t.Errorf("PATH was not inherited: %v", env)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// targetDialTimeout is how long the proxy waits to connect to a target before giving up on it.
+const targetDialTimeout = 10 * time.Second
+
+var targetDialer = &net.Dialer{Timeout: targetDialTimeout}
+
+// targetTransport sends requests to targets. Connections to targets are not reused.
+var targetTransport = &http.Transport{
+	DisableKeepAlives: true,
+	DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := targetDialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, &targetDialError{err}
+		}
+		return conn, nil
+	},
+}
+
+// A targetDialError indicates that a target could not be reached. Nothing has been sent to the
+// target, so the request may be retried on another one.
+type targetDialError struct {
+	err error
+}
+
+func (t *targetDialError) Error() string {
+	return t.err.Error()
+}
+
+// proxyTarget forwards a request to a target host. If the target cannot be reached, nothing is
+// written to w and a *targetDialError is returned. Any other failure results in a 502 response.
+func proxyTarget(w http.ResponseWriter, r *http.Request, host string) error {
+	if isWebSocket(r) {
+		return proxyWebSocketTarget(w, r, host)
+	}
+
+	targetURL := *r.URL
+	targetURL.Scheme = "http"
+	targetURL.Host = host
+
+	// The body is protected from being closed by a failed attempt, since it may be needed for
+	// another target.
+	var body io.Reader
+	if r.Body != nil && r.Body != http.NoBody {
+		body = ioutil.NopCloser(r.Body)
+	}
+	req, err := http.NewRequest(r.Method, targetURL.String(), body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil
+	}
+	req.ContentLength = r.ContentLength
+	req.Header = forwardedHeaders(r, false)
+	req.Host = r.Host
+
+	res, err := targetTransport.RoundTrip(req)
+	if err != nil {
+		var dialErr *targetDialError
+		if errors.As(err, &dialErr) {
+			return dialErr
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil
+	}
+	defer res.Body.Close()
+
+	for header, values := range res.Header {
+		if !isHopByHop(header, false) {
+			w.Header()[header] = values
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	if res.ContentLength < 0 {
+		// Responses of unknown length are often streams, which should not be delayed.
+		io.Copy(&flushWriter{w: w}, res.Body)
+	} else {
+		io.Copy(w, res.Body)
+	}
+	return nil
+}
+
+// proxyWebSocketTarget forwards a WebSocket request to a target host and pipes data between
+// the client and the target until either closes its connection.
+func proxyWebSocketTarget(w http.ResponseWriter, r *http.Request, host string) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection cannot be hijacked.", http.StatusBadGateway)
+		return nil
+	}
+	conn, err := targetDialer.Dial("tcp", host)
+	if err != nil {
+		return &targetDialError{err}
+	}
+	req := cloneRequest(r)
+	req.Header = forwardedHeaders(r, true)
+	req.Host = r.Host
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil
+	}
+	clientConn, clientRW, err := hijacker.Hijack()
+	if err != nil {
+		conn.Close()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil
+	}
+
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			clientRW.Flush()
+			conn.Close()
+			clientConn.Close()
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(conn, clientRW.Reader)
+		closeBoth()
+		close(done)
+	}()
+	io.Copy(&bufferedFlushWriter{clientRW.Writer}, conn)
+	closeBoth()
+	<-done
+	return nil
+}
+
+// isWebSocket returns whether a request asks to upgrade its connection to a WebSocket.
+func isWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forwardedHeaders returns the headers to send to a target for a request, without hop-by-hop
+// headers and with this hop added to the X-Forwarded-For, X-Forwarded-Host, and
+// X-Forwarded-Proto headers. If webSocket is set, the Connection and Upgrade headers are kept.
+func forwardedHeaders(r *http.Request, webSocket bool) http.Header {
+	res := http.Header{}
+	for header, values := range r.Header {
+		if !isHopByHop(header, webSocket) {
+			res[header] = values
+		}
+	}
+
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	proto := r.URL.Scheme
+	if proto == "" {
+		proto = "http"
+	}
+	forwarded := map[string]string{"For": clientIP, "Host": r.Host, "Proto": proto}
+	for key, value := range forwarded {
+		header := "X-Forwarded-" + key
+		if existing := r.Header.Get(header); existing != "" {
+			value = existing + ", " + value
+		}
+		res.Set(header, value)
+	}
+	return res
+}
+
+// isHopByHop returns whether a header applies only to a single connection and should not be
+// forwarded. If webSocket is set, the Connection and Upgrade headers are forwarded.
+func isHopByHop(header string, webSocket bool) bool {
+	switch http.CanonicalHeaderKey(header) {
+	case "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer",
+		"Transfer-Encoding":
+		return true
+	case "Connection", "Upgrade":
+		return !webSocket
+	}
+	return false
+}
+
+// A bufferedFlushWriter flushes a hijacked connection's buffer after each write.
+type bufferedFlushWriter struct {
+	w *bufio.Writer
+}
+
+func (b *bufferedFlushWriter) Write(p []byte) (int, error) {
+	n, err := b.w.Write(p)
+	if err == nil {
+		err = b.w.Flush()
+	}
+	return n, err
+}
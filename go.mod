@@ -8,11 +8,10 @@ require (
 	github.com/gorilla/sessions v1.2.1
 	github.com/hoisie/mustache v0.0.0-20160804235033-6375acf62c69
 	github.com/unixpickle/ezserver v0.0.0-20220804143526-d80e93d2a6dc
-	github.com/unixpickle/reverseproxy v0.0.0-20210706165131-af3733a47f5c
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
 )
 
 require (
 	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa // indirect
-	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2 // indirect
 	golang.org/x/text v0.3.6 // indirect
 )
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HeaderRules modifies the headers of proxied requests and their responses.
+//
+// Header values may contain the placeholders {client_ip}, {host}, {scheme}, {method}, {path}, and
+// {request_id}, which are replaced with the corresponding attributes of the request.
+type HeaderRules struct {
+	// Request is applied to requests before they are sent to a target.
+	Request HeaderActions
+
+	// Response is applied to responses before they are sent to the client.
+	Response HeaderActions
+}
+
+// Copy returns a deep copy of the HeaderRules.
+func (h *HeaderRules) Copy() *HeaderRules {
+	return &HeaderRules{h.Request.Copy(), h.Response.Copy()}
+}
+
+// Validate returns an error if any header name is invalid.
+func (h *HeaderRules) Validate() error {
+	for _, actions := range []HeaderActions{h.Request, h.Response} {
+		names := append([]string{}, actions.Remove...)
+		for name := range actions.Set {
+			names = append(names, name)
+		}
+		for name := range actions.Add {
+			names = append(names, name)
+		}
+		for _, name := range names {
+			if name == "" || strings.ContainsAny(name, " :\t\r\n") {
+				return errors.New("invalid header name: " + strconv.Quote(name))
+			}
+		}
+	}
+	return nil
+}
+
+// HeaderActions lists changes to make to a set of headers.
+// Headers are removed first, then set, then added.
+type HeaderActions struct {
+	// Remove lists headers to delete.
+	Remove []string
+
+	// Set maps headers to values which replace any existing values.
+	Set map[string]string
+
+	// Add maps headers to values which are appended to any existing values.
+	Add map[string]string
+}
+
+// Copy returns a deep copy of the HeaderActions.
+func (h HeaderActions) Copy() HeaderActions {
+	res := HeaderActions{Set: map[string]string{}, Add: map[string]string{}}
+	res.Remove = make([]string, len(h.Remove))
+	copy(res.Remove, h.Remove)
+	for key, val := range h.Set {
+		res.Set[key] = val
+	}
+	for key, val := range h.Add {
+		res.Add[key] = val
+	}
+	return res
+}
+
+// Apply modifies a header using the actions.
+// The replacer expands placeholders in header values.
+func (h HeaderActions) Apply(header http.Header, replacer *strings.Replacer) {
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	for name, value := range h.Set {
+		header.Set(name, replacer.Replace(value))
+	}
+	for name, value := range h.Add {
+		header.Add(name, replacer.Replace(value))
+	}
+}
+
+// headerReplacer creates a strings.Replacer which expands header value placeholders for a request.
+func headerReplacer(r *http.Request, requestID string) *strings.Replacer {
+	return strings.NewReplacer(
+		"{client_ip}", remoteIP(r),
+		"{host}", r.Host,
+		"{scheme}", requestScheme(r),
+		"{method}", r.Method,
+		"{path}", r.URL.Path,
+		"{request_id}", requestID,
+	)
+}
+
+// newRequestID generates a random identifier for a request.
+func newRequestID() string {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// requestScheme returns "https" if the request arrived over TLS and "http" otherwise.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
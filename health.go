@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthInterval = 10
+	defaultHealthTimeout  = 5
+	defaultHealthFall     = 3
+	defaultHealthRise     = 2
+)
+
+// TargetHealth is a snapshot of the health of a proxy target.
+type TargetHealth struct {
+	// Up is false if the target has failed too many consecutive probes.
+	Up bool
+
+	// LastCheck is the UNIX timestamp in milliseconds of the most recent probe.
+	LastCheck int64
+
+	// LastError is the error from the most recent probe, or "" if it succeeded.
+	LastError string
+}
+
+// A healthChecker probes the targets of a rule in the background.
+type healthChecker struct {
+	check HealthCheck
+
+	lock    sync.RWMutex
+	targets map[string]*targetState
+
+	stop chan struct{}
+}
+
+type targetState struct {
+	health    TargetHealth
+	successes int
+	failures  int
+
+	// stop is closed when the target is removed from the checker.
+	stop chan struct{}
+}
+
+// newHealthChecker starts probing a list of targets.
+// Targets are assumed to be up until their probes say otherwise.
+func newHealthChecker(check HealthCheck, targets []string) *healthChecker {
+	res := &healthChecker{check: check.withDefaults(), targets: map[string]*targetState{},
+		stop: make(chan struct{})}
+	res.SetTargets(targets)
+	return res
+}
+
+// SetTargets changes the list of targets to probe.
+// Targets which were already being probed keep their health.
+func (h *healthChecker) SetTargets(targets []string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	keep := map[string]bool{}
+	for _, target := range targets {
+		keep[target] = true
+		if _, ok := h.targets[target]; ok {
+			continue
+		}
+		state := &targetState{health: TargetHealth{Up: true}, stop: make(chan struct{})}
+		h.targets[target] = state
+		go h.loop(target, state)
+	}
+	for target, state := range h.targets {
+		if !keep[target] {
+			close(state.stop)
+			delete(h.targets, target)
+		}
+	}
+}
+
+// Health returns the health of every target.
+func (h *healthChecker) Health() map[string]TargetHealth {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	res := map[string]TargetHealth{}
+	for target, state := range h.targets {
+		res[target] = state.health
+	}
+	return res
+}
+
+// IsUp returns whether or not a target should receive requests.
+func (h *healthChecker) IsUp(target string) bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if state, ok := h.targets[target]; ok {
+		return state.health.Up
+	}
+	return true
+}
+
+// Stop terminates the background probes.
+func (h *healthChecker) Stop() {
+	close(h.stop)
+}
+
+func (h *healthChecker) loop(target string, state *targetState) {
+	ticker := time.NewTicker(time.Second * time.Duration(h.check.Interval))
+	defer ticker.Stop()
+	for {
+		h.record(state, h.probe(target))
+		select {
+		case <-ticker.C:
+		case <-state.stop:
+			return
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+func (h *healthChecker) probe(target string) error {
+	return probeTarget(h.check, target)
+}
+
+// probeTarget runs a single health check against a "host:port" address.
+func probeTarget(check HealthCheck, target string) error {
+	timeout := time.Second * time.Duration(check.Timeout)
+	if check.Type == "tcp" {
+		conn, err := net.DialTimeout("tcp", target, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DisableKeepAlives: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	path := check.Path
+	if path == "" || path[0] != '/' {
+		path = "/" + path
+	}
+	resp, err := client.Get("http://" + target + path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return errors.New("status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+// withDefaults returns a copy of the check with default values for its unset fields.
+func (check HealthCheck) withDefaults() HealthCheck {
+	if check.Interval <= 0 {
+		check.Interval = defaultHealthInterval
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = defaultHealthTimeout
+	}
+	if check.Fall <= 0 {
+		check.Fall = defaultHealthFall
+	}
+	if check.Rise <= 0 {
+		check.Rise = defaultHealthRise
+	}
+	return check
+}
+
+func (h *healthChecker) record(state *targetState, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	state.health.LastCheck = time.Now().UnixNano() / 1000000
+	if err != nil {
+		state.health.LastError = err.Error()
+		state.successes = 0
+		state.failures++
+		if state.failures >= h.check.Fall {
+			state.health.Up = false
+		}
+	} else {
+		state.health.LastError = ""
+		state.failures = 0
+		state.successes++
+		if state.successes >= h.check.Rise {
+			state.health.Up = true
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+)
+
+// defaultLifecycleHookTimeout is the number of seconds a pre-start, post-start, or post-stop
+// hook may run if the task does not set HookTimeout.
+const defaultLifecycleHookTimeout = 300
+
+// validateHooks returns an error if the task's pre-start, post-start, or post-stop hooks are
+// invalid.
+func (t *Task) validateHooks() error {
+	for _, hooks := range [][]string{t.PreStart, t.PostStart, t.PostStop} {
+		for _, command := range hooks {
+			if command == "" {
+				return errors.New("missing hook command")
+			}
+		}
+	}
+	if t.HookTimeout < 0 {
+		return errors.New("hook timeout must not be negative")
+	}
+	return nil
+}
+
+func (t *Task) hookTimeout() time.Duration {
+	if t.HookTimeout == 0 {
+		return time.Second * defaultLifecycleHookTimeout
+	}
+	return time.Second * time.Duration(t.HookTimeout)
+}
+
+// runHooks runs hook commands in order for a replica, logging their output to the backlog, and
+// stops at the first one which fails. The kind, such as "pre-start", is used in log messages.
+// Like the task's command, the hooks are subject to its resource limits and sandbox.
+//
+// While the hooks run, actions are answered as though the replica were running. If a stop
+// action arrives or actions is closed, stopped is set, and the running hook is killed if abort
+// is set. Stop actions are answered once the hooks are over. Actions may be nil.
+func (t *Task) runHooks(replica, port int, kind string, commands []string,
+	actions <-chan taskAction, abort bool) (stopped bool, err error) {
+	var stops []chan<- interface{}
+	defer func() {
+		for _, resp := range stops {
+			close(resp)
+		}
+	}()
+
+	for _, command := range commands {
+		t.pushReplicaBacklog(replica, BacklogLineStatus, "Running "+kind+" hook: "+command)
+		output := &backlogWriter{task: t, replica: replica}
+		cancel := make(chan struct{})
+		done := make(chan error, 1)
+		go func(command string) {
+			done <- t.runShell(replica, port, command, t.hookTimeout(), output, cancel)
+		}(command)
+
+		stop := func() {
+			if abort && !stopped {
+				close(cancel)
+			}
+			stopped = true
+		}
+	Wait:
+		for {
+			select {
+			case err = <-done:
+				break Wait
+			case val, ok := <-actions:
+				if !ok {
+					actions = nil
+					stop()
+				} else if val.action == taskActionStop {
+					stops = append(stops, val.resp)
+					stop()
+				} else if val.action == taskActionStatus {
+					val.resp <- TaskStatusRunning
+				} else if val.action == taskActionSignal {
+					val.resp <- errTaskNotRunning
+				} else {
+					close(val.resp)
+				}
+			}
+		}
+		output.Flush()
+
+		title := strings.ToUpper(kind[:1]) + kind[1:]
+		if err == errCommandCanceled {
+			t.pushReplicaBacklog(replica, BacklogLineStatus, title+" hook stopped.")
+			return stopped, err
+		} else if err != nil {
+			t.pushReplicaBacklog(replica, BacklogLineStatus,
+				title+" hook failed: "+err.Error()+".")
+			return stopped, err
+		} else if stopped && abort {
+			break
+		}
+	}
+	return stopped, nil
+}
+
+// startHooks runs hook commands like runHooks, but without waiting for them. The returned
+// function kills the running hook, if there is one, and waits for the hooks to end.
+func (t *Task) startHooks(replica, port int, kind string, commands []string) func() {
+	stop := make(chan taskAction)
+	done := make(chan struct{})
+	go func() {
+		t.runHooks(replica, port, kind, commands, stop, true)
+		close(done)
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// A backlogWriter is an io.Writer which logs each line written to it in a replica's backlog.
+type backlogWriter struct {
+	task    *Task
+	replica int
+	buffer  bytes.Buffer
+}
+
+func (b *backlogWriter) Write(p []byte) (int, error) {
+	for _, ch := range p {
+		if ch == '\n' {
+			b.Flush()
+		} else {
+			b.buffer.WriteByte(ch)
+		}
+	}
+	return len(p), nil
+}
+
+// Flush logs the partial line in the buffer, if there is one.
+func (b *backlogWriter) Flush() {
+	if b.buffer.Len() > 0 {
+		b.task.pushReplicaBacklog(b.replica, BacklogLineStdout, b.buffer.String())
+		b.buffer.Reset()
+	}
+}
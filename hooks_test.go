@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunHooks(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands []string
+		output   []string
+		failed   bool
+	}{
+		{"Environment", []string{"echo $PORT", "echo \"$NAME\""}, []string{"8080", "hook"}, false},
+		{"Partial", []string{"printf 'a\\nb'"}, []string{"a", "b"}, false},
+		{"Failure", []string{"echo first", "exit 1", "echo last"}, []string{"first"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			task := &Task{Args: []string{"true"}, Env: map[string]string{"NAME": "hook"}}
+			stopped, err := task.runHooks(0, 8080, "pre-start", test.commands, nil, true)
+			if stopped {
+				t.Fatal("unexpected stop")
+			}
+			if (err != nil) != test.failed {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var output []string
+			for _, line := range task.backlogs[0] {
+				if line.Type == BacklogLineStdout {
+					output = append(output, line.Data)
+				}
+			}
+			if !reflect.DeepEqual(output, test.output) {
+				t.Fatalf("expected output %q but got %q", test.output, output)
+			}
+		})
+	}
+}
+
+func TestRunHooksStop(t *testing.T) {
+	task := &Task{Args: []string{"true"}}
+	actions := make(chan taskAction)
+	resp := make(chan interface{})
+	go func() {
+		actions <- taskAction{action: taskActionStop, resp: resp}
+	}()
+	stopped, err := task.runHooks(0, 0, "pre-start", []string{"sleep 10", "echo next"}, actions,
+		true)
+	if !stopped || err != errCommandCanceled {
+		t.Fatalf("unexpected result: %v, %v", stopped, err)
+	}
+	if _, ok := <-resp; ok {
+		t.Fatal("stop was not answered")
+	}
+}
+
+func TestStartHooks(t *testing.T) {
+	task := &Task{Args: []string{"true"}}
+	stop := task.startHooks(0, 0, "post-start", []string{"sleep 10", "echo next"})
+	start := time.Now()
+	stop()
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("hook was not killed")
+	}
+	for _, line := range task.backlogs[0] {
+		if line.Type == BacklogLineStdout {
+			t.Fatalf("unexpected output %q", line.Data)
+		}
+	}
+}
+
+func TestPreStartOnce(t *testing.T) {
+	task := &Task{Args: []string{"true"}, Replicas: 3, PreStart: []string{"echo pre-start"}}
+	task.runReplicas(make(chan taskAction))
+	var count int
+	for _, backlog := range task.backlogs {
+		for _, line := range backlog {
+			if line.Type == BacklogLineStdout && line.Data == "pre-start" {
+				count++
+			}
+		}
+	}
+	if count != 1 {
+		t.Fatalf("pre-start hook ran %d times", count)
+	}
+}
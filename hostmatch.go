@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	hostPatternExact = iota
+	hostPatternWildcard
+	hostPatternRegexp
+)
+
+// parseHostPattern determines what kind of pattern a RuleTable key is.
+// For wildcard and regular expression patterns, it also returns an anchored, case-insensitive
+// expression equivalent to the pattern. The part of the host matched by a wildcard's "*" is the
+// expression's first capture group.
+func parseHostPattern(pattern string) (int, *regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, "~") {
+		expr, err := regexp.Compile("(?i)^(?:" + pattern[1:] + ")$")
+		if err != nil {
+			return 0, nil, err
+		}
+		return hostPatternRegexp, expr, nil
+	} else if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[2:]
+		if suffix == "" || strings.Contains(suffix, "*") {
+			return 0, nil, errors.New("invalid wildcard host: " + pattern)
+		}
+		expr := regexp.MustCompile("(?i)^(.+)\\." + regexp.QuoteMeta(suffix) + "$")
+		return hostPatternWildcard, expr, nil
+	} else if pattern != "*" && strings.Contains(pattern, "*") {
+		return 0, nil, errors.New("wildcard must be a leading \"*.\": " + pattern)
+	}
+	return hostPatternExact, nil, nil
+}
+
+// A hostTable finds the rule for a request's host.
+type hostTable struct {
+	exact     map[string]*hostState
+	wildcards []*hostPattern
+	regexps   []*hostPattern
+	fallback  *hostState
+}
+
+type hostPattern struct {
+	pattern  string
+	priority int
+	expr     *regexp.Regexp
+	state    *hostState
+}
+
+// A hostMatch is the result of looking up a host in a hostTable.
+type hostMatch struct {
+	state *hostState
+	host  string
+
+	// expr and submatches are set when the host matched a wildcard or regexp pattern.
+	expr       *regexp.Regexp
+	submatches []int
+}
+
+// Expand substitutes the pattern's capture groups into a template such as "$1.internal:8080".
+// Templates are returned unchanged if the host did not match a pattern.
+func (h *hostMatch) Expand(template string) string {
+	if h.expr == nil || !strings.Contains(template, "$") {
+		return template
+	}
+	return string(h.expr.ExpandString(nil, template, h.host, h.submatches))
+}
+
+// newHostTable creates a hostTable from the state for each key of a RuleTable.
+// The keys must have been validated with parseHostPattern.
+func newHostTable(hosts map[string]*hostState) *hostTable {
+	res := &hostTable{exact: map[string]*hostState{}}
+	for pattern, state := range hosts {
+		kind, expr, _ := parseHostPattern(pattern)
+		switch kind {
+		case hostPatternExact:
+			if pattern == "*" {
+				res.fallback = state
+			} else {
+				res.exact[strings.ToLower(pattern)] = state
+			}
+		case hostPatternWildcard:
+			res.wildcards = append(res.wildcards, &hostPattern{pattern, 0, expr, state})
+		case hostPatternRegexp:
+			res.regexps = append(res.regexps,
+				&hostPattern{pattern, state.rule.Priority, expr, state})
+		}
+	}
+
+	// The most specific wildcard is the one with the longest suffix.
+	sort.Slice(res.wildcards, func(i, j int) bool {
+		w1, w2 := res.wildcards[i].pattern, res.wildcards[j].pattern
+		if len(w1) != len(w2) {
+			return len(w1) > len(w2)
+		}
+		return w1 < w2
+	})
+	sort.Slice(res.regexps, func(i, j int) bool {
+		r1, r2 := res.regexps[i], res.regexps[j]
+		if r1.priority != r2.priority {
+			return r1.priority < r2.priority
+		}
+		return r1.pattern < r2.pattern
+	})
+
+	return res
+}
+
+// Lookup finds the rule for a host. Exact matches take precedence, followed by the most specific
+// wildcard, followed by regular expressions in order of priority, followed by the "*" rule.
+// Like the patterns, exact matches ignore case. The result is nil if no rule matches.
+func (h *hostTable) Lookup(host string) *hostMatch {
+	if state, ok := h.exact[strings.ToLower(host)]; ok {
+		return &hostMatch{state: state, host: host}
+	}
+	hostname := host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		hostname = name
+	}
+	if state, ok := h.exact[strings.ToLower(hostname)]; ok {
+		return &hostMatch{state: state, host: hostname}
+	}
+	for _, patterns := range [][]*hostPattern{h.wildcards, h.regexps} {
+		for _, pattern := range patterns {
+			if match := pattern.expr.FindStringSubmatchIndex(hostname); match != nil {
+				return &hostMatch{state: pattern.state, host: hostname, expr: pattern.expr,
+					submatches: match}
+			}
+		}
+	}
+	if h.fallback != nil {
+		return &hostMatch{state: h.fallback, host: host}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import "testing"
+
+func TestParseHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		kind    int
+		valid   bool
+	}{
+		{"example.com", hostPatternExact, true},
+		{"example.com:8080", hostPatternExact, true},
+		{"*", hostPatternExact, true},
+		{"*.example.com", hostPatternWildcard, true},
+		{"~(www\\.)?example\\.com", hostPatternRegexp, true},
+		{"*.", 0, false},
+		{"*.*.example.com", 0, false},
+		{"www.*.com", 0, false},
+		{"~(unclosed", 0, false},
+	}
+	for _, test := range tests {
+		kind, _, err := parseHostPattern(test.pattern)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: unexpected error: %v", test.pattern, err)
+		} else if test.valid && kind != test.kind {
+			t.Errorf("%q: expected kind %d but got %d", test.pattern, test.kind, kind)
+		}
+	}
+}
+
+func TestHostTableLookup(t *testing.T) {
+	patterns := map[string]int{
+		"example.com":                    0,
+		"api.example.com:8443":           0,
+		"*.example.com":                  0,
+		"*.dev.example.com":              0,
+		"~(?P<app>[a-z]+)-(\\d+)\\.test": 2,
+		"~[a-z]+-1\\.test":               1,
+		"*":                              0,
+	}
+	hosts := map[string]*hostState{}
+	for pattern, priority := range patterns {
+		hosts[pattern] = &hostState{rule: &Rule{Priority: priority}}
+	}
+	table := newHostTable(hosts)
+
+	tests := []struct {
+		host     string
+		pattern  string
+		template string
+		expanded string
+	}{
+		{"example.com", "example.com", "$1:80", "$1:80"},
+		{"example.com:8080", "example.com", "127.0.0.1:80", "127.0.0.1:80"},
+		{"Example.COM", "example.com", "", ""},
+		{"API.example.com:8443", "api.example.com:8443", "", ""},
+		{"api.example.com:8443", "api.example.com:8443", "", ""},
+		{"api.example.com", "*.example.com", "$1.internal:80", "api.internal:80"},
+		{"API.Example.com", "*.example.com", "${1}:80", "API:80"},
+		{"a.b.example.com", "*.example.com", "$1:80", "a.b:80"},
+		{"web.dev.example.com:80", "*.dev.example.com", "$1:80", "web:80"},
+		{"shop-1.test", "~[a-z]+-1\\.test", "", ""},
+		{"shop-2.test", "~(?P<app>[a-z]+)-(\\d+)\\.test", "${app}:${2}000", "shop:2000"},
+		{"shop-2.test.evil", "*", "$1:80", "$1:80"},
+		{"other.org", "*", "", ""},
+	}
+	for _, test := range tests {
+		match := table.Lookup(test.host)
+		if match == nil {
+			t.Errorf("%s: no match", test.host)
+			continue
+		}
+		if match.state != hosts[test.pattern] {
+			var actual string
+			for pattern, state := range hosts {
+				if state == match.state {
+					actual = pattern
+				}
+			}
+			t.Errorf("%s: expected %q but matched %q", test.host, test.pattern, actual)
+			continue
+		}
+		if test.template != "" {
+			if expanded := match.Expand(test.template); expanded != test.expanded {
+				t.Errorf("%s: expected %q to expand to %q but got %q", test.host,
+					test.template, test.expanded, expanded)
+			}
+		}
+	}
+
+	delete(hosts, "*")
+	if match := newHostTable(hosts).Lookup("other.org"); match != nil {
+		t.Error("expected no match without a fallback rule")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// An IPFilter restricts which client addresses may access a host or the control panel.
+// Entries are CIDR ranges like "10.0.0.0/8" or single addresses like "192.168.1.5".
+type IPFilter struct {
+	// Allow, if non-empty, lists the only clients which may connect.
+	Allow []string
+
+	// Deny lists clients which may not connect, even if they are allowed by Allow.
+	Deny []string
+
+	// compiled holds the parsed entries once the filter has been validated.
+	compiled *ipFilter
+}
+
+// Copy returns a deep copy of the IPFilter.
+func (f *IPFilter) Copy() *IPFilter {
+	return &IPFilter{Allow: append([]string{}, f.Allow...), Deny: append([]string{}, f.Deny...)}
+}
+
+// Validate returns an error if any entry is not a valid address or CIDR range.
+// The parsed entries are kept for Allows, so the filter should not be changed afterwards.
+func (f *IPFilter) Validate() error {
+	compiled, err := compileIPFilter(f)
+	if err != nil {
+		return err
+	}
+	f.compiled = compiled
+	return nil
+}
+
+// Allows returns whether or not a client IP address passes the filter.
+// The entries are only parsed here if the filter has not been validated.
+func (f *IPFilter) Allows(ip string) bool {
+	compiled := f.compiled
+	if compiled == nil {
+		var err error
+		if compiled, err = compileIPFilter(f); err != nil {
+			return false
+		}
+	}
+	return compiled.Allows(ip)
+}
+
+// An ipFilter is a parsed IPFilter.
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func compileIPFilter(f *IPFilter) (*ipFilter, error) {
+	allow, err := parseNetworks(f.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseNetworks(f.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &ipFilter{allow, deny}, nil
+}
+
+// Allows returns whether or not a client IP address passes the filter.
+func (f *ipFilter) Allows(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	if containsIP(f.deny, parsed) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, parsed)
+}
+
+// parseNetworks parses a list of CIDR ranges and addresses.
+// An address is treated as a range containing only that address.
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.New("invalid IP address: " + entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, network)
+	}
+	return res, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type clientIPKey struct{}
+
+// clientIP determines the address of the client which made a request.
+// If the request came from a trusted proxy, X-Forwarded-For is followed from right to left until
+// an untrusted address is found.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trusted, ip) {
+		return host
+	}
+	var hops []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			// A malformed entry cannot be trusted, so stop at the last trusted hop.
+			break
+		}
+		host = hop
+		if !containsIP(trusted, hopIP) {
+			break
+		}
+	}
+	return host
+}
+
+// withClientIP records the client address of a request so that remoteIP will return it.
+func withClientIP(r *http.Request, ip string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+}
+
+// remoteIP returns the IP address of the client which sent a request.
+// This is the address recorded by withClientIP, if there is one.
+func remoteIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
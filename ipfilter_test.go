@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestIPFilter(t *testing.T) {
+	filter := &IPFilter{Allow: []string{"10.0.0.0/8", "192.168.1.5"}, Deny: []string{"10.0.0.1"}}
+	if err := filter.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"10.1.2.3":    true,
+		"10.0.0.1":    false,
+		"192.168.1.5": true,
+		"192.168.1.6": false,
+		"not an ip":   false,
+	}
+	for ip, expected := range tests {
+		if actual := filter.Allows(ip); actual != expected {
+			t.Errorf("%s: expected %v but got %v", ip, expected, actual)
+		}
+	}
+
+	if err := (&IPFilter{Deny: []string{"10.0.0.0/33"}}).Validate(); err == nil {
+		t.Error("expected an error for an invalid range")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxRateBuckets is the number of client buckets a rateLimiter may store. Once it is reached,
+// the least recently used bucket is discarded to make room for a new one.
+const maxRateBuckets = 10000
+
+// Limits restricts how much traffic the proxy forwards for a host.
+// Requests which exceed a limit are rejected with status 429.
+type Limits struct {
+	// Rate is the number of requests per second which each client may make, on average.
+	// If it is 0, requests are not rate limited.
+	Rate float64
+
+	// Burst is the number of requests a client may make at once after being idle.
+	// Values less than 1 are treated as 1.
+	Burst int
+
+	// KeyHeader, if non-empty, is a request header which identifies clients for rate limiting.
+	// Otherwise, clients are identified by IP address.
+	KeyHeader string
+
+	// MaxConns is the maximum number of concurrent requests for the host, or 0 for no limit.
+	MaxConns int
+
+	// MaxTargetConns is the maximum number of concurrent requests for each target, or 0 for no
+	// limit.
+	MaxTargetConns int
+}
+
+// Validate returns an error if the limits are invalid.
+func (l *Limits) Validate() error {
+	if l.Rate < 0 || math.IsNaN(l.Rate) || math.IsInf(l.Rate, 0) {
+		return errors.New("invalid rate limit")
+	}
+	if l.Burst < 0 || l.MaxConns < 0 || l.MaxTargetConns < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+// LimitStats counts the requests which were rejected for a host.
+type LimitStats struct {
+	RateRejected int64
+	ConnRejected int64
+}
+
+// A rateLimiter implements a token bucket for each client.
+type rateLimiter struct {
+	rate      float64
+	burst     float64
+	keyHeader string
+
+	lock    sync.Mutex
+	buckets map[string]*list.Element
+
+	// recent holds the *tokenBucket values of buckets, most recently used first.
+	recent *list.List
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limits *Limits) *rateLimiter {
+	burst := float64(limits.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: limits.Rate, burst: burst, keyHeader: limits.KeyHeader,
+		buckets: map[string]*list.Element{}, recent: list.New()}
+}
+
+// Allow takes a token from the client's bucket. If the bucket is empty, it returns false and the
+// time until a token will be available.
+func (r *rateLimiter) Allow(req *http.Request) (bool, time.Duration) {
+	key := remoteIP(req)
+	if r.keyHeader != "" {
+		key = req.Header.Get(r.keyHeader)
+	}
+
+	now := time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	elem, ok := r.buckets[key]
+	if ok {
+		r.recent.MoveToFront(elem)
+	} else {
+		r.discardIdle(now)
+		if len(r.buckets) >= maxRateBuckets {
+			r.remove(r.recent.Back())
+		}
+		elem = r.recent.PushFront(&tokenBucket{key: key, tokens: r.burst, last: now})
+		r.buckets[key] = elem
+	}
+	bucket := elem.Value.(*tokenBucket)
+	r.refill(bucket, now)
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / r.rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+func (r *rateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * r.rate
+	if bucket.tokens > r.burst {
+		bucket.tokens = r.burst
+	}
+	bucket.last = now
+}
+
+// discardIdle removes the least recently used buckets which have refilled completely, since
+// they behave the same as new buckets.
+func (r *rateLimiter) discardIdle(now time.Time) {
+	for elem := r.recent.Back(); elem != nil; elem = r.recent.Back() {
+		bucket := elem.Value.(*tokenBucket)
+		r.refill(bucket, now)
+		if bucket.tokens < r.burst {
+			return
+		}
+		r.remove(elem)
+	}
+}
+
+func (r *rateLimiter) remove(elem *list.Element) {
+	delete(r.buckets, elem.Value.(*tokenBucket).key)
+	r.recent.Remove(elem)
+}
+
+// acquireConn increments a counter of in-flight requests unless it has reached max.
+// A max of 0 means there is no limit.
+func acquireConn(counter *int64, max int) bool {
+	for {
+		count := atomic.LoadInt64(counter)
+		if max > 0 && count >= int64(max) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(counter, count, count+1) {
+			return true
+		}
+	}
+}
+
+// serveTooManyRequests rejects a request which exceeded a limit.
+func serveTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many requests.", http.StatusTooManyRequests)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  Limits
+		clients []string
+		allowed []bool
+	}{
+		{"Burst", Limits{Rate: 1, Burst: 3}, []string{"a", "a", "a", "a"},
+			[]bool{true, true, true, false}},
+		{"DefaultBurst", Limits{Rate: 1}, []string{"a", "a"}, []bool{true, false}},
+		{"Clients", Limits{Rate: 1}, []string{"a", "b", "a", "b", "c"},
+			[]bool{true, true, false, false, true}},
+		{"KeyHeader", Limits{Rate: 1, KeyHeader: "X-Key"}, []string{"a", "a", "b"},
+			[]bool{true, false, true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newRateLimiter(&test.limits)
+			for i, client := range test.clients {
+				req := httptest.NewRequest("GET", "/", nil)
+				if test.limits.KeyHeader != "" {
+					req.Header.Set(test.limits.KeyHeader, client)
+				} else {
+					req.RemoteAddr = "10.0.0." + strconv.Itoa(int(client[0])) + ":1234"
+				}
+				ok, wait := limiter.Allow(req)
+				if ok != test.allowed[i] {
+					t.Fatalf("request %d: expected %v but got %v", i, test.allowed[i], ok)
+				}
+				if !ok && (wait <= 0 || wait > time.Second) {
+					t.Fatalf("request %d: unexpected wait %v", i, wait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	limiter := newRateLimiter(&Limits{Rate: 0.001, Burst: 1, KeyHeader: "X-Key"})
+	allow := func(key string) bool {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Key", key)
+		ok, _ := limiter.Allow(req)
+		return ok
+	}
+	for i := 0; i < maxRateBuckets+100; i++ {
+		if i == maxRateBuckets/2 {
+			// Using a bucket keeps it from being evicted.
+			allow("0")
+		}
+		allow(strconv.Itoa(i))
+	}
+	if len(limiter.buckets) != maxRateBuckets || limiter.recent.Len() != maxRateBuckets {
+		t.Fatalf("expected %d buckets but got %d", maxRateBuckets, len(limiter.buckets))
+	}
+	if allow("0") {
+		t.Error("recently used bucket was evicted")
+	}
+	if !allow("1") {
+		t.Error("least recently used bucket was kept")
+	}
+}
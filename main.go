@@ -13,6 +13,10 @@ var GlobalConfig *Config
 var GlobalServer *Server
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == execHelperArg {
+		runExecHelper(os.Args[2:])
+	}
+
 	// Deal with the arguments.
 	if len(os.Args) != 3 {
 		log.Fatal("Usage: " + os.Args[0] + " <port> <config.json>")
@@ -29,15 +33,16 @@ func main() {
 		log.Fatal("Failed to load configuration: " + err.Error())
 	}
 
+	// The audit log is kept beside the configuration.
+	if err := AuditLog.Open(ConfigPath + ".audit"); err != nil {
+		log.Print("Failed to open audit log: " + err.Error())
+	}
+
 	// Run the tasks before we start the servers so the configuration page isn't accessible until
 	// the tasks are started.
 	GlobalConfig.Lock()
-	for _, t := range GlobalConfig.Tasks {
-		t.StartLoop()
-		if t.AutoRun {
-			t.Start()
-		}
-	}
+	TaskCgroups.Enabled = GlobalConfig.ManageCgroups
+	startTasks(GlobalConfig.Tasks)
 	GlobalConfig.Unlock()
 
 	// Start the servers.
@@ -56,8 +61,15 @@ func main() {
 }
 
 func shutdown() {
+	// Stop tasks before the tasks they depend on.
 	GlobalConfig.Lock()
-	for _, t := range GlobalConfig.Tasks {
+	order, _ := dependencyOrder(GlobalConfig.Tasks)
+	for i := len(order) - 1; i >= 0; i-- {
+		t := order[i]
+		if t.deployment != nil {
+			t.deployment.StopLoop()
+			t.deployment = nil
+		}
 		t.StopLoop()
 	}
 	if GlobalServer != nil {
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// defaultRetryAfter is the Retry-After value, in seconds, sent during maintenance if a rule does
+// not specify one.
+const defaultRetryAfter = 300
+
+// ErrorPageStatuses lists the statuses for which a rule may have a custom error page.
+var ErrorPageStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout}
+
+// Maintenance configures the page which a host serves while it is down for maintenance.
+type Maintenance struct {
+	// Enabled puts the host into maintenance mode.
+	Enabled bool
+
+	// Page is the HTML which is served during maintenance. If it is empty, the rule's 503 error
+	// page or a default message is used.
+	Page string
+
+	// RetryAfter is the number of seconds sent in the Retry-After header. If it is 0,
+	// defaultRetryAfter is used.
+	RetryAfter int
+
+	// Allow lists clients whose requests are still forwarded during maintenance, in the same
+	// format as IPFilter.Allow.
+	Allow []string
+}
+
+// Copy returns a deep copy of the Maintenance.
+func (m *Maintenance) Copy() *Maintenance {
+	res := *m
+	res.Allow = append([]string{}, m.Allow...)
+	return &res
+}
+
+// Validate returns an error if the Maintenance is invalid.
+func (m *Maintenance) Validate() error {
+	if m.RetryAfter < 0 {
+		return errors.New("retry time must not be negative")
+	}
+	_, err := parseNetworks(m.Allow)
+	return err
+}
+
+// validateErrorPages returns an error if a rule has error pages for unsupported statuses.
+func validateErrorPages(pages map[int]string) error {
+	for status := range pages {
+		if !isErrorPageStatus(status) {
+			return errors.New("unsupported error page status: " + strconv.Itoa(status))
+		}
+	}
+	return nil
+}
+
+func isErrorPageStatus(status int) bool {
+	for _, s := range ErrorPageStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// serveMaintenance responds to a request for a host which is down for maintenance.
+// The maintenance settings may be nil, in which case the defaults are used.
+func serveMaintenance(w http.ResponseWriter, m *Maintenance, errorPages map[int]string) {
+	retryAfter := defaultRetryAfter
+	page := errorPages[http.StatusServiceUnavailable]
+	if m != nil {
+		if m.RetryAfter > 0 {
+			retryAfter = m.RetryAfter
+		}
+		if m.Page != "" {
+			page = m.Page
+		}
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	if page == "" {
+		http.Error(w, "Down for maintenance.", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(page))
+}
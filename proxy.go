@@ -0,0 +1,549 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Proxy handles HTTP requests and forwards them through a RuleTable.
+type Proxy struct {
+	lock  sync.RWMutex
+	rules RuleTable
+	hosts map[string]*hostState
+	table *hostTable
+
+	// taskTargets maps hosts to the targets provided by tasks, which are added to the hosts'
+	// rules.
+	taskTargets map[string][]*Target
+
+	// trusted lists the proxies whose X-Forwarded-For headers are believed.
+	trusted []*net.IPNet
+
+	accessLog *AccessLogger
+}
+
+// hostState stores the runtime state which the proxy keeps for each rule.
+type hostState struct {
+	rule *Rule
+	root *routeState
+
+	// paths is sorted so that longer prefixes come first.
+	paths []*pathState
+
+	// filter is nil if the rule does not restrict client addresses.
+	filter *ipFilter
+
+	// limiter is nil if the rule is not rate limited.
+	limiter *rateLimiter
+
+	// active is the number of in-flight requests for the host.
+	active int64
+	stats  LimitStats
+
+	// maintenance is 1 while the host is in maintenance mode. It is changed by SetMaintenance
+	// without replacing the rule.
+	maintenance int32
+
+	// maintenanceAllow lists the clients which bypass maintenance mode.
+	maintenanceAllow []*net.IPNet
+}
+
+type pathState struct {
+	rule  *PathRule
+	route *routeState
+}
+
+// routeState stores the runtime state of a single Route.
+type routeState struct {
+	route   *Route
+	checker *healthChecker
+
+	// targets holds a *targetSet. It is replaced when the targets which tasks provide change,
+	// so the route's own Targets are only its initial targets.
+	targets atomic.Value
+}
+
+// A targetSet is the targets of a route and the state used to balance requests among them.
+type targetSet struct {
+	targets  []*Target
+	balancer balancer
+
+	// active maps each target host to its number of in-flight requests.
+	active map[string]*int64
+}
+
+func newHostState(rule *Rule) *hostState {
+	res := &hostState{rule: rule, root: newRouteState(&rule.Route)}
+	for _, path := range rule.Paths {
+		res.paths = append(res.paths, &pathState{path, newRouteState(&path.Route)})
+	}
+	sort.SliceStable(res.paths, func(i, j int) bool {
+		return len(res.paths[i].rule.Prefix) > len(res.paths[j].rule.Prefix)
+	})
+	if rule.Access != nil {
+		// The rule table has already been validated.
+		res.filter, _ = compileIPFilter(rule.Access)
+	}
+	if rule.Limits != nil && rule.Limits.Rate > 0 {
+		res.limiter = newRateLimiter(rule.Limits)
+	}
+	if rule.Maintenance != nil {
+		res.maintenanceAllow, _ = parseNetworks(rule.Maintenance.Allow)
+		if rule.Maintenance.Enabled {
+			res.maintenance = 1
+		}
+	}
+	return res
+}
+
+// maxConns returns the host's connection limits, which are 0 if there is no limit.
+func (h *hostState) maxConns() (host, target int) {
+	if h.rule.Limits == nil {
+		return 0, 0
+	}
+	return h.rule.Limits.MaxConns, h.rule.Limits.MaxTargetConns
+}
+
+// match finds the route for a request path.
+// The returned PathRule is nil if the rule's own route should be used.
+func (h *hostState) match(urlPath string) (*PathRule, *routeState) {
+	for _, path := range h.paths {
+		if path.rule.Matches(urlPath) {
+			return path.rule, path.route
+		}
+	}
+	return nil, h.root
+}
+
+// inMaintenance returns whether a request should receive the maintenance page.
+func (h *hostState) inMaintenance(r *http.Request) bool {
+	if atomic.LoadInt32(&h.maintenance) == 0 {
+		return false
+	}
+	ip := net.ParseIP(remoteIP(r))
+	return ip == nil || !containsIP(h.maintenanceAllow, ip)
+}
+
+func (h *hostState) stop() {
+	h.root.stop()
+	for _, path := range h.paths {
+		path.route.stop()
+	}
+}
+
+func newRouteState(route *Route) *routeState {
+	res := &routeState{route: route}
+	if route.HealthCheck != nil {
+		res.checker = newHealthChecker(*route.HealthCheck, checkedHosts(route.Targets))
+	}
+	res.setTargets(route.Targets)
+	return res
+}
+
+// checkedHosts returns the hosts of the targets which can be health checked.
+// Targets which use capture groups cannot be probed without a request.
+func checkedHosts(targets []*Target) []string {
+	var hosts []string
+	for _, target := range targets {
+		if !strings.Contains(target.Host, "$") {
+			hosts = append(hosts, target.Host)
+		}
+	}
+	return hosts
+}
+
+// setTargets replaces the route's targets. The health, in-flight request counts, and
+// round-robin balancing state of the targets which remain are kept.
+func (s *routeState) setTargets(targets []*Target) {
+	set := &targetSet{targets: targets, active: map[string]*int64{}}
+	old, _ := s.targets.Load().(*targetSet)
+	for _, target := range targets {
+		if old != nil && old.active[target.Host] != nil {
+			set.active[target.Host] = old.active[target.Host]
+		} else if set.active[target.Host] == nil {
+			set.active[target.Host] = new(int64)
+		}
+	}
+	var roundRobin *roundRobinBalancer
+	if old != nil {
+		roundRobin, _ = old.balancer.(*roundRobinBalancer)
+	}
+	if roundRobin != nil {
+		roundRobin.retain(targets)
+		set.balancer = roundRobin
+	} else {
+		route := *s.route
+		route.Targets = targets
+		set.balancer = newBalancer(&route, set.active)
+	}
+	if old != nil && s.checker != nil {
+		s.checker.SetTargets(checkedHosts(targets))
+	}
+	s.targets.Store(set)
+}
+
+func (s *routeState) currentTargets() *targetSet {
+	return s.targets.Load().(*targetSet)
+}
+
+// pick selects a healthy target for a request, skipping the targets in exclude.
+// It returns nil if no such target is healthy.
+func (t *targetSet) pick(r *http.Request, checker *healthChecker,
+	exclude map[*Target]bool) *Target {
+	candidates := make([]*Target, 0, len(t.targets))
+	for _, target := range t.targets {
+		if exclude[target] {
+			continue
+		}
+		if checker == nil || checker.IsUp(target.Host) {
+			candidates = append(candidates, target)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return t.balancer.Pick(r, candidates)
+}
+
+// stop terminates the route's background health checks.
+func (s *routeState) stop() {
+	if s.checker != nil {
+		s.checker.Stop()
+	}
+}
+
+// NewProxy creates a Proxy with an initial RuleTable and access log configuration.
+func NewProxy(rules RuleTable, accessLog AccessLogConfig) *Proxy {
+	res := &Proxy{accessLog: NewAccessLogger(accessLog), taskTargets: map[string][]*Target{}}
+	res.SetRuleTable(rules)
+	return res
+}
+
+// AccessLog returns the logger which records the Proxy's requests.
+func (p *Proxy) AccessLog() *AccessLogger {
+	return p.accessLog
+}
+
+// Health returns the health of every target which is being health checked, keyed by route and
+// then by target. Routes are named by their host, followed by their path prefix if they have one.
+func (p *Proxy) Health() map[string]map[string]TargetHealth {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	res := map[string]map[string]TargetHealth{}
+	for host, state := range p.hosts {
+		if state.root.checker != nil {
+			res[host] = state.root.checker.Health()
+		}
+		for _, path := range state.paths {
+			if path.route.checker != nil {
+				res[host+path.rule.Prefix] = path.route.checker.Health()
+			}
+		}
+	}
+	return res
+}
+
+// LimitStats returns the number of requests which were rejected for each host since the rule
+// table was last set.
+func (p *Proxy) LimitStats() map[string]LimitStats {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	res := map[string]LimitStats{}
+	for host, state := range p.hosts {
+		res[host] = LimitStats{
+			RateRejected: atomic.LoadInt64(&state.stats.RateRejected),
+			ConnRejected: atomic.LoadInt64(&state.stats.ConnRejected),
+		}
+	}
+	return res
+}
+
+// RuleTable returns the Proxy's current rule table.
+func (p *Proxy) RuleTable() RuleTable {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.rules.Copy()
+}
+
+// ServeHTTP forwards a request to one of the healthy targets for its host and path.
+// See hostTable.Lookup for the order in which host patterns are matched.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	p.lock.RLock()
+	match := p.table.Lookup(r.Host)
+	trusted := p.trusted
+	p.lock.RUnlock()
+	if match == nil {
+		w.Write([]byte("No forward rule found."))
+		return
+	}
+
+	r = withClientIP(r, clientIP(r, trusted))
+
+	// The scheme is used to generate the X-Forwarded-Proto header.
+	r = cloneRequest(r)
+	r.URL.Scheme = requestScheme(r)
+
+	rule := match.state.rule
+	requestID := newRequestID()
+	entry := &AccessLogEntry{
+		Time:      start.UnixNano() / 1000000,
+		RequestID: requestID,
+		ClientIP:  remoteIP(r),
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      r.URL.RequestURI(),
+		Proto:     r.Proto,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+	if r.TLS != nil {
+		entry.TLSVersion = tlsVersionName(r.TLS.Version)
+	}
+
+	pw := &proxyResponseWriter{ResponseWriter: w}
+	if rule.Headers != nil {
+		replacer := headerReplacer(r, requestID)
+		rule.Headers.Request.Apply(r.Header, replacer)
+		pw.beforeHeader = func(h http.Header, status int) {
+			rule.Headers.Response.Apply(h, replacer)
+		}
+	}
+	entry.Upstream = p.limitAndForward(pw, r, match)
+
+	entry.Status = pw.status
+	if !pw.wroteHeader {
+		entry.Status = http.StatusOK
+	}
+	entry.Bytes = pw.bytes
+	entry.Latency = float64(time.Since(start)) / float64(time.Millisecond)
+	p.accessLog.Log(entry, rule.AccessLog)
+}
+
+// UsesSessionAuth returns whether the rule for a host requires a control panel session.
+func (p *Proxy) UsesSessionAuth(host string) bool {
+	p.lock.RLock()
+	match := p.table.Lookup(host)
+	p.lock.RUnlock()
+	if match == nil {
+		return false
+	}
+	auth := match.state.rule.Auth
+	return auth != nil && auth.Type == AuthSession
+}
+
+// SetMaintenance turns maintenance mode on or off for the rule with the given key.
+// Unlike SetRuleTable, this does not reset the rule's health checks or balancing state.
+// It returns false if there is no such rule.
+func (p *Proxy) SetMaintenance(host string, enabled bool) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	state, ok := p.hosts[host]
+	if !ok || p.rules[host] == nil {
+		return false
+	}
+
+	// The rule is copied because requests read the old one without holding the lock.
+	rule := p.rules[host].Copy()
+	if rule.Maintenance == nil {
+		rule.Maintenance = &Maintenance{}
+	}
+	rule.Maintenance.Enabled = enabled
+	p.rules[host] = rule
+
+	var flag int32
+	if enabled {
+		flag = 1
+	}
+	atomic.StoreInt32(&state.maintenance, flag)
+	return true
+}
+
+// SetTaskTargets sets the targets which tasks provide for a host, in addition to the targets of
+// its rule. If the host has no rule, requests for it are forwarded to the tasks' targets alone.
+// The health checks, balancing state, and limits of the host are kept.
+func (p *Proxy) SetTaskTargets(host string, targets []*Target) {
+	p.lock.Lock()
+	if len(targets) == 0 {
+		delete(p.taskTargets, host)
+	} else {
+		p.taskTargets[host] = targets
+	}
+	oldState := p.hosts[host]
+	rule := withTaskTargets(p.rules[host], targets)
+	if rule != nil && oldState != nil {
+		oldState.root.setTargets(rule.Targets)
+		p.lock.Unlock()
+		return
+	}
+	if rule != nil {
+		p.hosts[host] = newHostState(rule)
+	} else {
+		delete(p.hosts, host)
+	}
+	p.table = newHostTable(p.hosts)
+	p.lock.Unlock()
+
+	if oldState != nil {
+		oldState.stop()
+	}
+}
+
+// SetTrustedProxies sets the proxies whose X-Forwarded-For headers are used to determine the
+// addresses of clients. The entries must be valid for parseNetworks.
+func (p *Proxy) SetTrustedProxies(entries []string) {
+	trusted, _ := parseNetworks(entries)
+	p.lock.Lock()
+	p.trusted = trusted
+	p.lock.Unlock()
+}
+
+// SetRuleTable updates the rule table used by the Proxy.
+// This resets the health checks and balancing state of every rule.
+func (p *Proxy) SetRuleTable(t RuleTable) {
+	rules := t.Copy()
+
+	p.lock.Lock()
+	hosts := map[string]*hostState{}
+	for host, rule := range rules {
+		hosts[host] = newHostState(withTaskTargets(rule, p.taskTargets[host]))
+	}
+	for host, targets := range p.taskTargets {
+		if _, ok := hosts[host]; !ok {
+			hosts[host] = newHostState(withTaskTargets(nil, targets))
+		}
+	}
+	oldHosts := p.hosts
+	p.rules = rules
+	p.hosts = hosts
+	p.table = newHostTable(hosts)
+	p.lock.Unlock()
+
+	for _, state := range oldHosts {
+		state.stop()
+	}
+}
+
+// limitAndForward enforces the host's access restrictions, maintenance mode, limits, and
+// authentication before forwarding a request.
+// It returns the address of the target, or "" if the request was not forwarded.
+func (p *Proxy) limitAndForward(w *proxyResponseWriter, r *http.Request, match *hostMatch) string {
+	state := match.state
+	if state.filter != nil && !state.filter.Allows(remoteIP(r)) {
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return ""
+	}
+	if state.inMaintenance(r) {
+		serveMaintenance(w, state.rule.Maintenance, state.rule.ErrorPages)
+		return ""
+	}
+	if state.limiter != nil {
+		if ok, wait := state.limiter.Allow(r); !ok {
+			atomic.AddInt64(&state.stats.RateRejected, 1)
+			serveTooManyRequests(w, wait)
+			return ""
+		}
+	}
+	if auth := state.rule.Auth; auth != nil && !auth.Authenticate(w, r) {
+		return ""
+	}
+	maxConns, _ := state.maxConns()
+	if !acquireConn(&state.active, maxConns) {
+		atomic.AddInt64(&state.stats.ConnRejected, 1)
+		serveTooManyRequests(w, time.Second)
+		return ""
+	}
+	defer atomic.AddInt64(&state.active, -1)
+	return p.forward(w, r, match)
+}
+
+// forward sends a request to the appropriate target for a matched rule.
+// It returns the address of the target (a file URL for static routes, or the location for
+// redirects), or "" if no target was available.
+// Error responses are replaced by the rule's error pages.
+func (p *Proxy) forward(w *proxyResponseWriter, r *http.Request, match *hostMatch) string {
+	w.errorPages = match.state.rule.ErrorPages
+	pathRule, route := match.state.match(r.URL.Path)
+	if pathRule != nil {
+		r.URL.Path = pathRule.Rewrite(r.URL.Path)
+		r.URL.RawPath = ""
+	}
+	if redirect := route.route.Redirect; redirect != nil && redirect.Applies(r) {
+		return redirect.Serve(w, r, match)
+	}
+	if route.route.Static != nil {
+		route.route.Static.ServeHTTP(w, r)
+		return "file://" + route.route.Static.Root
+	}
+	targets := route.currentTargets()
+	if len(targets.targets) == 0 {
+		http.NotFound(w, r)
+		return ""
+	}
+	target := targets.pick(r, route.checker, nil)
+	if target == nil {
+		http.Error(w, "No healthy targets.", http.StatusServiceUnavailable)
+		return ""
+	}
+
+	// Targets which are at their connection limit are skipped, and if a target cannot be reached,
+	// the request is passed to the next target the balancer picks, until none remain.
+	_, maxTargetConns := match.state.maxConns()
+	tried := map[*Target]bool{}
+	var lastErr error
+	var lastHost string
+	for ; target != nil; target = targets.pick(r, route.checker, tried) {
+		tried[target] = true
+		counter := targets.active[target.Host]
+		if !acquireConn(counter, maxTargetConns) {
+			continue
+		}
+		host := match.Expand(target.Host)
+		err := proxyTarget(w, r, host)
+		atomic.AddInt64(counter, -1)
+		if err == nil {
+			return host
+		}
+		lastErr, lastHost = err, host
+	}
+	if lastErr != nil {
+		http.Error(w, lastErr.Error(), http.StatusBadGateway)
+		return lastHost
+	}
+	atomic.AddInt64(&match.state.stats.ConnRejected, 1)
+	serveTooManyRequests(w, time.Second)
+	return ""
+}
+
+// withTaskTargets returns a rule with extra targets from tasks added to its own targets.
+// The rule may be nil, in which case a rule with only the tasks' targets is returned, or nil if
+// there are no such targets.
+func withTaskTargets(rule *Rule, targets []*Target) *Rule {
+	if len(targets) == 0 {
+		return rule
+	}
+	if rule == nil {
+		rule = &Rule{}
+	} else {
+		rule = rule.Copy()
+	}
+	for _, target := range targets {
+		t := *target
+		rule.Targets = append(rule.Targets, &t)
+	}
+	return rule
+}
+
+// cloneRequest returns a shallow copy of a request with its own URL.
+func cloneRequest(r *http.Request) *http.Request {
+	res := new(http.Request)
+	*res = *r
+	u := *r.URL
+	res.URL = &u
+	return res
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProxyFailover(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("live " + string(body)))
+	}))
+	defer live.Close()
+	liveHost := strings.TrimPrefix(live.URL, "http://")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadHost := listener.Addr().String()
+	listener.Close()
+
+	tests := []struct {
+		name    string
+		balance string
+		targets []string
+		status  int
+		body    string
+	}{
+		{"Live", BalanceRandom, []string{liveHost}, http.StatusOK, "live data"},
+		{"DeadFirst", BalanceRoundRobin, []string{deadHost, liveHost}, http.StatusOK, "live data"},
+		{"DeadLast", BalanceRoundRobin, []string{liveHost, deadHost}, http.StatusOK, "live data"},
+		{"LeastConn", BalanceLeastConn, []string{deadHost, liveHost}, http.StatusOK, "live data"},
+		{"AllDead", BalanceRandom, []string{deadHost, deadHost}, http.StatusBadGateway, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := &Rule{Route: Route{Balance: test.balance}}
+			for _, host := range test.targets {
+				rule.Targets = append(rule.Targets, &Target{Host: host})
+			}
+			proxy := NewProxy(RuleTable{"example.com": rule}, AccessLogConfig{})
+			defer proxy.SetRuleTable(RuleTable{})
+
+			// Each target is reached first by some request.
+			for i := 0; i < len(test.targets)*2; i++ {
+				req := httptest.NewRequest("POST", "http://example.com/",
+					strings.NewReader("data"))
+				rec := httptest.NewRecorder()
+				proxy.ServeHTTP(rec, req)
+				if rec.Code != test.status {
+					t.Fatalf("expected status %d but got %d", test.status, rec.Code)
+				}
+				if test.body != "" && rec.Body.String() != test.body {
+					t.Fatalf("expected body %q but got %q", test.body, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestTargetConnLimit(t *testing.T) {
+	var hosts []string
+	for _, name := range []string{"a", "b"} {
+		name := name
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer server.Close()
+		hosts = append(hosts, strings.TrimPrefix(server.URL, "http://"))
+	}
+	rule := &Rule{Route: Route{Targets: []*Target{{Host: hosts[0]}, {Host: hosts[1]}},
+		Balance: BalanceRoundRobin}, Limits: &Limits{MaxTargetConns: 1}}
+	proxy := NewProxy(RuleTable{"example.com": rule}, AccessLogConfig{})
+	defer proxy.SetRuleTable(RuleTable{})
+	active := proxy.hosts["example.com"].root.currentTargets().active
+
+	// The first target is busy, so every request goes to the second.
+	atomic.StoreInt64(active[hosts[0]], 1)
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "b" {
+			t.Fatalf("unexpected response: %d %q", rec.Code, rec.Body.String())
+		}
+	}
+
+	atomic.StoreInt64(active[hosts[1]], 1)
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429 but got %d", rec.Code)
+	}
+}
+
+func TestSetTaskTargets(t *testing.T) {
+	servers := make([]*httptest.Server, 2)
+	hosts := make([]string, 2)
+	for i := range servers {
+		name := strconv.Itoa(i)
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer servers[i].Close()
+		hosts[i] = strings.TrimPrefix(servers[i].URL, "http://")
+	}
+
+	rule := &Rule{Route: Route{Balance: BalanceRoundRobin,
+		HealthCheck: &HealthCheck{Type: "tcp", Interval: 3600}}}
+	proxy := NewProxy(RuleTable{"example.com": rule}, AccessLogConfig{})
+	defer proxy.SetRuleTable(RuleTable{})
+	get := func() string {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+		return rec.Body.String()
+	}
+
+	state := proxy.hosts["example.com"]
+	checker := state.root.checker
+	steps := []struct {
+		hosts     []string
+		responses []string
+	}{
+		{hosts[:1], []string{"0", "0"}},
+		{hosts, []string{"0", "1", "0", "1"}},
+		{hosts[1:], []string{"1", "1"}},
+	}
+	for i, step := range steps {
+		var targets []*Target
+		for _, host := range step.hosts {
+			targets = append(targets, &Target{Host: host})
+		}
+		proxy.SetTaskTargets("example.com", targets)
+		if proxy.hosts["example.com"] != state || state.root.checker != checker {
+			t.Fatal("host state was replaced")
+		}
+		health := checker.Health()
+		if len(health) != len(targets) {
+			t.Errorf("expected %d checked targets but got %v", len(targets), health)
+		}
+		var actual []string
+		for range step.responses {
+			actual = append(actual, get())
+		}
+		if !reflect.DeepEqual(actual, step.responses) {
+			t.Errorf("step %d: expected responses %v but got %v", i, step.responses, actual)
+		}
+	}
+
+	proxy.SetTaskTargets("example.com", nil)
+	if body := get(); !strings.Contains(body, "404") {
+		t.Errorf("unexpected response without targets: %q", body)
+	}
+}
+
+func TestIsWebSocket(t *testing.T) {
+	tests := []struct {
+		upgrade    string
+		connection []string
+		expected   bool
+	}{
+		{"websocket", []string{"Upgrade"}, true},
+		{"WebSocket", []string{"keep-alive, upgrade"}, true},
+		{"websocket", []string{"keep-alive", "Upgrade"}, true},
+		{"websocket", nil, false},
+		{"websocket", []string{"keep-alive"}, false},
+		{"h2c", []string{"Upgrade"}, false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Upgrade", test.upgrade)
+		r.Header["Connection"] = test.connection
+		if actual := isWebSocket(r); actual != test.expected {
+			t.Errorf("%q %q: expected %v but got %v", test.upgrade, test.connection,
+				test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A Redirect answers requests with a redirect instead of forwarding them to targets.
+type Redirect struct {
+	// Status is 301, 302, 307, or 308. If it is 0, 301 is used.
+	Status int
+
+	// URL is a template for the redirect destination, such as "https://www.{host}{uri}".
+	//
+	// It may contain the placeholders {scheme}, {host} (including the port, if any), {hostname}
+	// (without the port), {path}, {query} (including the "?", if there is a query), and {uri}
+	// (the path followed by the query). Paths are given after the rule's path rewriting.
+	// For rules with wildcard or regular expression hosts, capture groups can be substituted
+	// using "$1" or "${name}".
+	URL string
+
+	// InsecureOnly limits the redirect to requests which did not arrive over TLS. Requests made
+	// over TLS are handled by the rest of the route instead.
+	InsecureOnly bool
+}
+
+// Validate returns an error if the redirect is invalid.
+func (r *Redirect) Validate() error {
+	switch r.Status {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect:
+	default:
+		return errors.New("invalid redirect status: " + strconv.Itoa(r.Status))
+	}
+	if r.URL == "" {
+		return errors.New("missing redirect URL")
+	}
+	return nil
+}
+
+// Applies returns whether the redirect should handle a request.
+func (r *Redirect) Applies(req *http.Request) bool {
+	return !r.InsecureOnly || req.TLS == nil
+}
+
+// Serve redirects a request to the expanded URL template and returns the location.
+func (r *Redirect) Serve(w http.ResponseWriter, req *http.Request, match *hostMatch) string {
+	hostname := req.Host
+	if name, _, err := net.SplitHostPort(req.Host); err == nil {
+		hostname = name
+	}
+	query := ""
+	if req.URL.RawQuery != "" {
+		query = "?" + req.URL.RawQuery
+	}
+	replacer := strings.NewReplacer(
+		"{scheme}", requestScheme(req),
+		"{host}", req.Host,
+		"{hostname}", hostname,
+		"{path}", req.URL.EscapedPath(),
+		"{query}", query,
+		"{uri}", req.URL.EscapedPath()+query,
+	)
+	location := replacer.Replace(match.Expand(r.URL))
+
+	status := r.Status
+	if status == 0 {
+		status = http.StatusMovedPermanently
+	}
+	w.Header().Set("Location", location)
+	w.WriteHeader(status)
+	return location
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// rlimitNproc is RLIMIT_NPROC on Linux, which the syscall package does not define.
+const rlimitNproc = 6
+
+// execHelperArg is the first argument which makes goule run as an exec helper instead of a
+// server. The helper is started in place of a task's command. It waits until goule has placed it
+// in the task's cgroup, applies the task's rlimits, and then executes the command.
+const execHelperArg = "__exec"
+
+// execRlimitsEnv is the environment variable in which goule passes rlimits to the exec helper.
+const execRlimitsEnv = "GOULE_RLIMITS"
+
+// ResourceLimits restricts the resources which a task's processes may use.
+// MemoryMax, CPUMax, and PidsMax are enforced with a cgroup, so they need ManageCgroups to be
+// set in the configuration.
+type ResourceLimits struct {
+	// OpenFiles, Processes, CoreSize, and CPUTime are rlimits applied to each process of the
+	// task when it starts. CoreSize is in bytes and CPUTime is in seconds. If one of them is
+	// nil, the process inherits goule's limit.
+	OpenFiles *uint64
+	Processes *uint64
+	CoreSize  *uint64
+	CPUTime   *uint64
+
+	// MemoryMax is the number of bytes of memory which the task may use in total. If it is 0,
+	// memory is not limited.
+	MemoryMax int64
+
+	// CPUMax is the number of CPUs which the task may use in total, such as 0.5 for half of one
+	// CPU. If it is 0, CPU is not limited.
+	CPUMax float64
+
+	// PidsMax is the number of processes and threads which the task may have in total. If it is
+	// 0, they are not limited.
+	PidsMax int64
+}
+
+// Validate returns an error if the ResourceLimits are invalid.
+func (r *ResourceLimits) Validate() error {
+	if r.MemoryMax < 0 || r.CPUMax < 0 || r.PidsMax < 0 {
+		return errors.New("resource limits must not be negative")
+	}
+	return nil
+}
+
+// usesCgroup returns whether the limits can only be enforced with a cgroup.
+func (r *ResourceLimits) usesCgroup() bool {
+	return r != nil && (r.MemoryMax != 0 || r.CPUMax != 0 || r.PidsMax != 0)
+}
+
+// rlimitSpec encodes the rlimits for the exec helper as a list of "resource=value" pairs.
+// It returns "" if there are no rlimits.
+func (r *ResourceLimits) rlimitSpec() string {
+	if r == nil {
+		return ""
+	}
+	limits := []struct {
+		resource int
+		value    *uint64
+	}{
+		{syscall.RLIMIT_NOFILE, r.OpenFiles},
+		{rlimitNproc, r.Processes},
+		{syscall.RLIMIT_CORE, r.CoreSize},
+		{syscall.RLIMIT_CPU, r.CPUTime},
+	}
+	var pairs []string
+	for _, limit := range limits {
+		if limit.value != nil {
+			pairs = append(pairs, strconv.Itoa(limit.resource)+"="+
+				strconv.FormatUint(*limit.value, 10))
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// applyRlimits sets the current process's rlimits from a spec made by rlimitSpec.
+func applyRlimits(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	names := map[int]string{syscall.RLIMIT_NOFILE: "open files", rlimitNproc: "processes",
+		syscall.RLIMIT_CORE: "core size", syscall.RLIMIT_CPU: "CPU time"}
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("invalid rlimit: " + pair)
+		}
+		resource, err1 := strconv.Atoi(parts[0])
+		value, err2 := strconv.ParseUint(parts[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return errors.New("invalid rlimit: " + pair)
+		}
+		limit := syscall.Rlimit{Cur: value, Max: value}
+		if err := syscall.Setrlimit(resource, &limit); err != nil {
+			return fmt.Errorf("setting %s limit: %s", names[resource], err)
+		}
+	}
+	return nil
+}
+
+// runExecHelper runs goule as an exec helper. The arguments are the path of the command followed
+// by its arguments, including the zeroth. Without arguments, the helper exits immediately, which
+// goule uses to check whether it can create namespaces. It does not return.
+func runExecHelper(args []string) {
+	if len(args) == 0 {
+		os.Exit(0)
+	}
+	runtime.LockOSThread()
+
+	// Goule writes to or closes the pipe on descriptor 3 once the helper is in its cgroup.
+	ready := os.NewFile(3, "ready")
+	ready.Read(make([]byte, 1))
+	ready.Close()
+
+	var env []string
+	for _, entry := range os.Environ() {
+		if !strings.HasPrefix(entry, execRlimitsEnv+"=") &&
+			!strings.HasPrefix(entry, execSandboxEnv+"=") {
+			env = append(env, entry)
+		}
+	}
+	err := errors.New("missing command")
+	if len(args) >= 2 {
+		err = applyRlimits(os.Getenv(execRlimitsEnv))
+		if err == nil {
+			err = applySandbox(os.Getenv(execSandboxEnv))
+		}
+		if err == nil {
+			err = syscall.Exec(args[0], args[1:], env)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "goule: "+err.Error())
+	os.Exit(127)
+}
+
+// startCommand starts a command for a replica of the task. If the task has rlimits, a cgroup, or
+// a sandbox, the command is started through the exec helper so that they apply before it runs.
+func (t *Task) startCommand(replica int, cmd *exec.Cmd) error {
+	rlimits := t.Resources.rlimitSpec()
+	cgroup := t.cgroupDir()
+	if rlimits == "" && cgroup == "" && t.Sandbox == nil {
+		return cmd.Start()
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyWriter.Close()
+
+	cmd.Args = append([]string{self, execHelperArg, cmd.Path}, cmd.Args...)
+	cmd.Path = self
+	if (rlimits != "" || t.Sandbox != nil) && cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	if rlimits != "" {
+		cmd.Env = append(cmd.Env, execRlimitsEnv+"="+rlimits)
+	}
+	if t.Sandbox != nil {
+		spec := t.sandboxCommand(replica, cmd)
+		cmd.Env = append(cmd.Env, execSandboxEnv+"="+encodeSandboxSpec(spec))
+	}
+	cmd.ExtraFiles = []*os.File{readyReader}
+	err = cmd.Start()
+	readyReader.Close()
+	if err != nil {
+		return err
+	}
+
+	if cgroup != "" {
+		if err := joinCgroup(cgroup, cmd.Process.Pid); err != nil {
+			t.pushReplicaBacklog(replica, BacklogLineStatus,
+				"Error joining cgroup: "+err.Error()+".")
+		}
+	}
+	readyWriter.Write([]byte{0})
+	return nil
+}
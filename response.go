@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// A proxyResponseWriter wraps the http.ResponseWriter for a proxied request.
+// It lets the proxy modify the headers right before they are sent, and it supports the
+// http.Flusher and http.Hijacker interfaces needed to proxy streams and WebSockets.
+type proxyResponseWriter struct {
+	http.ResponseWriter
+
+	// beforeHeader, if non-nil, is called once before the response headers are written.
+	beforeHeader func(header http.Header, status int)
+
+	// errorPages maps statuses to HTML which replaces the body of responses with those statuses.
+	errorPages map[int]string
+
+	status      int
+	bytes       int64
+	wroteHeader bool
+
+	// discard is set when the body is being replaced by an error page.
+	discard bool
+}
+
+func (p *proxyResponseWriter) WriteHeader(status int) {
+	if p.wroteHeader {
+		return
+	}
+	p.wroteHeader = true
+	p.status = status
+	page, replace := p.errorPages[status]
+	if replace {
+		h := p.Header()
+		h.Del("Content-Length")
+		h.Del("Content-Encoding")
+		h.Set("Content-Type", "text/html; charset=utf-8")
+	}
+	if p.beforeHeader != nil {
+		p.beforeHeader(p.Header(), status)
+	}
+	p.ResponseWriter.WriteHeader(status)
+	if replace {
+		n, _ := p.ResponseWriter.Write([]byte(page))
+		p.bytes += int64(n)
+		p.discard = true
+	}
+}
+
+func (p *proxyResponseWriter) Write(data []byte) (int, error) {
+	if !p.wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
+	if p.discard {
+		return len(data), nil
+	}
+	n, err := p.ResponseWriter.Write(data)
+	p.bytes += int64(n)
+	return n, err
+}
+
+func (p *proxyResponseWriter) Flush() {
+	if f, ok := p.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (p *proxyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := p.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	p.wroteHeader = true
+	p.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// A RuleTable associates a Rule with each host handled by the proxy.
+//
+// Keys may be exact hosts, wildcards such as "*.example.com", or regular expressions prefixed
+// with "~", such as "~(www\\.)?example\\.(com|org)". Regular expressions are anchored to match
+// the entire host. The special host "*" matches requests for which no other rule exists.
+type RuleTable map[string]*Rule
+
+// Copy returns a deep copy of a RuleTable.
+func (r RuleTable) Copy() RuleTable {
+	res := RuleTable{}
+	for key, val := range r {
+		res[key] = val.Copy()
+	}
+	return res
+}
+
+// Validate returns an error if any rule in the table is invalid.
+func (r RuleTable) Validate() error {
+	for host, rule := range r {
+		if rule == nil {
+			return errors.New("missing rule for host: " + host)
+		}
+		if _, _, err := parseHostPattern(host); err != nil {
+			return errors.New(host + ": " + err.Error())
+		}
+		if err := rule.Validate(); err != nil {
+			return errors.New(host + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// HashPasswords hashes the new basic auth passwords of every rule. See ProxyAuth.HashPasswords.
+func (r RuleTable) HashPasswords() {
+	for _, rule := range r {
+		if rule != nil && rule.Auth != nil {
+			rule.Auth.HashPasswords()
+		}
+	}
+}
+
+// A Rule describes where the proxy forwards requests for a host.
+// Requests whose paths match one of the rule's Paths are handled by that path's route, while all
+// other requests are handled by the rule's own route.
+type Rule struct {
+	Route
+
+	// Paths lists routes for specific path prefixes. The longest matching prefix wins.
+	Paths []*PathRule
+
+	// Priority orders rules with regular expression hosts. Lower priorities are tried first, and
+	// ties are broken by comparing the expressions.
+	Priority int
+
+	// Headers, if non-nil, modifies the headers of requests and responses for the host.
+	Headers *HeaderRules
+
+	// AccessLog, if non-empty, is a file to which the host's requests are logged in addition to
+	// the main access log.
+	AccessLog string
+
+	// Limits, if non-nil, restricts the rate and concurrency of requests for the host.
+	Limits *Limits
+
+	// Access, if non-nil, restricts which clients may access the host.
+	Access *IPFilter
+
+	// Auth, if non-nil, requires clients to authenticate before their requests are forwarded.
+	Auth *ProxyAuth
+
+	// ErrorPages maps 502, 503, and 504 to HTML which replaces the body of responses with those
+	// statuses, whether they come from the proxy or from a target.
+	ErrorPages map[int]string
+
+	// Maintenance, if non-nil, configures the host's maintenance mode.
+	Maintenance *Maintenance
+}
+
+// Copy returns a deep copy of a Rule.
+func (r *Rule) Copy() *Rule {
+	res := *r
+	res.Route = r.Route.Copy()
+	res.Paths = make([]*PathRule, len(r.Paths))
+	for i, path := range r.Paths {
+		p := *path
+		p.Route = path.Route.Copy()
+		res.Paths[i] = &p
+	}
+	if r.Headers != nil {
+		res.Headers = r.Headers.Copy()
+	}
+	if r.Limits != nil {
+		limits := *r.Limits
+		res.Limits = &limits
+	}
+	if r.Access != nil {
+		res.Access = r.Access.Copy()
+	}
+	if r.Auth != nil {
+		res.Auth = r.Auth.Copy()
+	}
+	if r.ErrorPages != nil {
+		res.ErrorPages = map[int]string{}
+		for status, page := range r.ErrorPages {
+			res.ErrorPages[status] = page
+		}
+	}
+	if r.Maintenance != nil {
+		res.Maintenance = r.Maintenance.Copy()
+	}
+	return &res
+}
+
+// Validate returns an error if the rule is invalid.
+func (r *Rule) Validate() error {
+	if err := r.Route.Validate(); err != nil {
+		return err
+	}
+	if r.Headers != nil {
+		if err := r.Headers.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.Limits != nil {
+		if err := r.Limits.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.Access != nil {
+		if err := r.Access.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.Auth != nil {
+		if err := r.Auth.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateErrorPages(r.ErrorPages); err != nil {
+		return err
+	}
+	if r.Maintenance != nil {
+		if err := r.Maintenance.Validate(); err != nil {
+			return err
+		}
+	}
+	prefixes := map[string]bool{}
+	for _, path := range r.Paths {
+		if path == nil {
+			return errors.New("missing path rule")
+		}
+		if !strings.HasPrefix(path.Prefix, "/") {
+			return errors.New("path prefix must start with /: " + path.Prefix)
+		}
+		if prefixes[path.Prefix] {
+			return errors.New("duplicate path prefix: " + path.Prefix)
+		}
+		prefixes[path.Prefix] = true
+		if path.AddPrefix != "" && !strings.HasPrefix(path.AddPrefix, "/") {
+			return errors.New("added prefix must start with /: " + path.AddPrefix)
+		}
+		if err := path.Route.Validate(); err != nil {
+			return errors.New(path.Prefix + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// UnmarshalJSON decodes a Rule.
+// For compatibility with older configurations, a plain list of targets is also accepted.
+func (r *Rule) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		*r = Rule{}
+		return json.Unmarshal(data, &r.Targets)
+	}
+	type rawRule Rule
+	var raw rawRule
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*r = Rule(raw)
+	return nil
+}
+
+// A PathRule routes requests whose paths begin with a prefix.
+type PathRule struct {
+	Route
+
+	// Prefix is matched against the request path one segment at a time, so "/api" matches
+	// "/api" and "/api/users" but not "/apis".
+	Prefix string
+
+	// StripPrefix removes Prefix from the path before the request is forwarded.
+	StripPrefix bool
+
+	// AddPrefix is prepended to the path (after StripPrefix is applied) before the request is
+	// forwarded.
+	AddPrefix string
+}
+
+// Matches returns whether or not the rule applies to a request path.
+func (p *PathRule) Matches(urlPath string) bool {
+	if !strings.HasPrefix(urlPath, p.Prefix) {
+		return false
+	}
+	return len(urlPath) == len(p.Prefix) || strings.HasSuffix(p.Prefix, "/") ||
+		urlPath[len(p.Prefix)] == '/'
+}
+
+// Rewrite applies StripPrefix and AddPrefix to a matching request path.
+func (p *PathRule) Rewrite(urlPath string) string {
+	if p.StripPrefix {
+		urlPath = strings.TrimPrefix(urlPath, p.Prefix)
+	}
+	if p.AddPrefix != "" {
+		urlPath = strings.TrimSuffix(p.AddPrefix, "/") + "/" + strings.TrimPrefix(urlPath, "/")
+	}
+	if !strings.HasPrefix(urlPath, "/") {
+		urlPath = "/" + urlPath
+	}
+	return urlPath
+}
+
+// A Route describes a set of targets and how requests are spread across them, or another way of
+// answering requests, such as serving a directory.
+type Route struct {
+	// Targets is a list of servers which can serve the route.
+	Targets []*Target
+
+	// Balance selects how requests are spread across the targets. It is one of the BalanceXXX
+	// constants. The empty string is equivalent to BalanceRandom.
+	Balance string
+
+	// HashCookie is the name of the cookie which BalanceCookieHash uses to pin clients to targets.
+	HashCookie string
+
+	// HealthCheck, if non-nil, causes the proxy to probe each target and
+	// stop forwarding requests to targets which fail their probes.
+	HealthCheck *HealthCheck
+
+	// Static, if non-nil, serves files from a local directory instead of forwarding requests.
+	// A route with a StaticSite may not have targets.
+	Static *StaticSite
+
+	// Redirect, if non-nil, answers requests with a redirect. Unless the redirect is InsecureOnly,
+	// a route with a Redirect may not have targets or a StaticSite.
+	Redirect *Redirect
+}
+
+// Copy returns a deep copy of a Route.
+func (r Route) Copy() Route {
+	res := r
+	res.Targets = make([]*Target, len(r.Targets))
+	for i, target := range r.Targets {
+		t := *target
+		res.Targets[i] = &t
+	}
+	if r.HealthCheck != nil {
+		check := *r.HealthCheck
+		res.HealthCheck = &check
+	}
+	if r.Static != nil {
+		res.Static = r.Static.Copy()
+	}
+	if r.Redirect != nil {
+		redirect := *r.Redirect
+		res.Redirect = &redirect
+	}
+	return res
+}
+
+// Validate returns an error if the route is invalid.
+func (r Route) Validate() error {
+	for _, target := range r.Targets {
+		if target == nil {
+			return errors.New("missing target")
+		}
+	}
+	switch r.Balance {
+	case "", BalanceRandom, BalanceRoundRobin, BalanceLeastConn, BalanceIPHash:
+	case BalanceCookieHash:
+		if r.HashCookie == "" {
+			return errors.New("missing hash cookie name")
+		}
+	default:
+		return errors.New("invalid balancing mode: " + r.Balance)
+	}
+	if r.HealthCheck != nil {
+		if err := r.HealthCheck.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.Static != nil {
+		if len(r.Targets) > 0 {
+			return errors.New("a static route cannot have targets")
+		}
+		if err := r.Static.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.Redirect != nil {
+		if !r.Redirect.InsecureOnly && (len(r.Targets) > 0 || r.Static != nil) {
+			return errors.New("a redirect route cannot have targets or a static site")
+		}
+		if err := r.Redirect.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TargetHosts returns the address of every target.
+func (r Route) TargetHosts() []string {
+	res := make([]string, len(r.Targets))
+	for i, target := range r.Targets {
+		res[i] = target.Host
+	}
+	return res
+}
+
+// A Target is a server to which the proxy forwards requests.
+type Target struct {
+	// Host is the "host:port" address of the server.
+	// For rules with wildcard or regular expression hosts, capture groups can be substituted
+	// into the address using "$1" or "${name}". The "*" of a wildcard is the first group.
+	Host string
+
+	// Weight is the share of requests this target receives relative to the rule's other targets.
+	// Weights less than 1 are treated as 1.
+	Weight int
+}
+
+// UnmarshalJSON decodes a Target.
+// For compatibility with older configurations, a plain host string is also accepted.
+func (t *Target) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("\"")) {
+		*t = Target{Weight: 1}
+		return json.Unmarshal(data, &t.Host)
+	}
+	type rawTarget Target
+	var raw rawTarget
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*t = Target(raw)
+	return nil
+}
+
+// weight returns the target's effective weight.
+func (t *Target) weight() int {
+	if t.Weight < 1 {
+		return 1
+	}
+	return t.Weight
+}
+
+// A HealthCheck configures the periodic probes which determine whether a rule's targets are up.
+type HealthCheck struct {
+	// Type is either "http" or "tcp". A TCP probe succeeds if a connection can be established. An
+	// HTTP probe succeeds if the target responds with a status code below 400.
+	Type string
+
+	// Path is the path requested by HTTP probes.
+	Path string
+
+	// Interval is the number of seconds between probes.
+	Interval int
+
+	// Timeout is the number of seconds before a probe is considered failed.
+	Timeout int
+
+	// Fall is the number of consecutive failed probes after which a target is marked down.
+	Fall int
+
+	// Rise is the number of consecutive successful probes after which a down target is marked up.
+	Rise int
+}
+
+// Validate returns an error if the health check is invalid.
+func (h *HealthCheck) Validate() error {
+	switch h.Type {
+	case "http", "tcp":
+		return nil
+	default:
+		return errors.New("invalid health check type: " + h.Type)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRuleJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected *Rule
+	}{
+		{
+			"LegacyHosts",
+			`["127.0.0.1:8080", "127.0.0.1:8081"]`,
+			&Rule{Route: Route{Targets: []*Target{{"127.0.0.1:8080", 1},
+				{"127.0.0.1:8081", 1}}}},
+		},
+		{
+			"LegacyEmpty",
+			`[]`,
+			&Rule{Route: Route{Targets: []*Target{}}},
+		},
+		{
+			"MixedTargets",
+			`{"Targets": ["127.0.0.1:8080", {"Host": "127.0.0.1:8081", "Weight": 3}],
+			  "Balance": "round-robin"}`,
+			&Rule{Route: Route{Targets: []*Target{{"127.0.0.1:8080", 1},
+				{"127.0.0.1:8081", 3}}, Balance: BalanceRoundRobin}},
+		},
+		{
+			"HealthCheck",
+			`{"Targets": ["127.0.0.1:8080"],
+			  "HealthCheck": {"Type": "http", "Path": "/health", "Interval": 5}}`,
+			&Rule{Route: Route{Targets: []*Target{{"127.0.0.1:8080", 1}},
+				HealthCheck: &HealthCheck{Type: "http", Path: "/health", Interval: 5}}},
+		},
+		{
+			"Paths",
+			`{"Targets": ["127.0.0.1:8080"],
+			  "Paths": [{"Prefix": "/api", "StripPrefix": true, "Targets": ["127.0.0.1:9000"]}]}`,
+			&Rule{Route: Route{Targets: []*Target{{"127.0.0.1:8080", 1}}},
+				Paths: []*PathRule{{Route: Route{Targets: []*Target{{"127.0.0.1:9000", 1}}},
+					Prefix: "/api", StripPrefix: true}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rule *Rule
+			if err := json.Unmarshal([]byte(test.data), &rule); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rule, test.expected) {
+				t.Fatalf("expected %+v but got %+v", test.expected, rule)
+			}
+			if err := rule.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Rules must survive being saved and loaded again.
+			data, err := json.Marshal(rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded *Rule
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, rule) {
+				t.Fatalf("round trip changed %+v to %+v", rule, decoded)
+			}
+		})
+	}
+}
+
+func TestRuleTableJSON(t *testing.T) {
+	data := `{"example.com": ["127.0.0.1:8080"], "*": {"Targets": ["127.0.0.1:8081"]}}`
+	var table RuleTable
+	if err := json.Unmarshal([]byte(data), &table); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(table) != 2 || table["example.com"].Targets[0].Host != "127.0.0.1:8080" ||
+		table["*"].Targets[0].Host != "127.0.0.1:8081" {
+		t.Fatalf("unexpected table: %+v", table)
+	}
+}
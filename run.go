@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultRunTimeout = 300
+	maxRunTimeout     = 3600
+)
+
+var (
+	errCommandTimedOut = errors.New("timed out")
+	errCommandCanceled = errors.New("canceled")
+)
+
+// RunCommand runs a one-off shell command with the task's directory, environment, credentials,
+// resource limits, and sandbox, writing its combined output to w. The command's process group
+// is killed if it runs longer than timeout or if cancel is closed. The result is the error from
+// waiting for the command, errCommandTimedOut, or errCommandCanceled.
+func (t *Task) RunCommand(command string, timeout time.Duration, w io.Writer,
+	cancel <-chan struct{}) error {
+	return t.runShell(0, 0, command, timeout, w, cancel)
+}
+
+// runShell is like RunCommand, but gives the command the environment of a replica of the task.
+func (t *Task) runShell(replica, port int, command string, timeout time.Duration, w io.Writer,
+	cancel <-chan struct{}) error {
+	cmd, err := t.shellCommand(replica, port, command)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := t.startCommand(replica, cmd); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		err = errCommandTimedOut
+	case <-cancel:
+		err = errCommandCanceled
+	}
+	signalCommand(cmd, syscall.SIGKILL)
+	<-done
+	return err
+}
+
+// shellCommand creates a command which runs a shell command line with the directory,
+// environment, and credentials of a replica of the task. It should be started with
+// startCommand.
+func (t *Task) shellCommand(replica, port int, command string) (*exec.Cmd, error) {
+	base, err := t.cmd(replica, port)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env, cmd.Dir, cmd.SysProcAttr = base.Env, base.Dir, base.SysProcAttr
+	return cmd, nil
+}
+
+// A flushWriter writes to an HTTP response and flushes each write to the client.
+// It may be used from multiple goroutines.
+type flushWriter struct {
+	lock sync.Mutex
+	w    http.ResponseWriter
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goule-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		command string
+		timeout time.Duration
+		output  string
+		err     string
+	}{
+		{"Output", "echo $GREETING; echo oops >&2", time.Minute, "hello\noops\n", ""},
+		{"Directory", "basename \"$(pwd)\"", time.Minute, filepath.Base(dir) + "\n", ""},
+		{"ExitStatus", "exit 3", time.Minute, "", "exit status 3"},
+		{"Timeout", "sleep 10", time.Millisecond * 100, "", errCommandTimedOut.Error()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			task := &Task{Args: []string{"true"}, Dir: dir,
+				Env: map[string]string{"GREETING": "hello"}}
+			var output bytes.Buffer
+			err := task.RunCommand(test.command, test.timeout, &output, nil)
+			errStr := ""
+			if err != nil {
+				errStr = err.Error()
+			}
+			if errStr != test.err {
+				t.Fatalf("expected error %q but got %q", test.err, errStr)
+			}
+			if test.output != "" && output.String() != test.output {
+				t.Fatalf("expected output %q but got %q", test.output, output.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// SeccompDefault is a seccomp profile which denies system calls for administering the host, such
+// as mount, reboot, kexec_load, and ptrace, with EPERM.
+const SeccompDefault = "default"
+
+// execSandboxEnv is the environment variable in which goule passes a sandboxSpec to the exec
+// helper.
+const execSandboxEnv = "GOULE_SANDBOX"
+
+const (
+	prSetNoNewPrivs = 38
+	prCapbsetDrop   = 24
+	prSetSeccomp    = 22
+
+	seccompModeFilter = 2
+	seccompRetAllow   = 0x7fff0000
+	seccompRetErrno   = 0x00050000
+)
+
+// capabilityNames are the names of the Linux capabilities, indexed by number.
+var capabilityNames = []string{"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_DAC_READ_SEARCH",
+	"CAP_FOWNER", "CAP_FSETID", "CAP_KILL", "CAP_SETGID", "CAP_SETUID", "CAP_SETPCAP",
+	"CAP_LINUX_IMMUTABLE", "CAP_NET_BIND_SERVICE", "CAP_NET_BROADCAST", "CAP_NET_ADMIN",
+	"CAP_NET_RAW", "CAP_IPC_LOCK", "CAP_IPC_OWNER", "CAP_SYS_MODULE", "CAP_SYS_RAWIO",
+	"CAP_SYS_CHROOT", "CAP_SYS_PTRACE", "CAP_SYS_PACCT", "CAP_SYS_ADMIN", "CAP_SYS_BOOT",
+	"CAP_SYS_NICE", "CAP_SYS_RESOURCE", "CAP_SYS_TIME", "CAP_SYS_TTY_CONFIG", "CAP_MKNOD",
+	"CAP_LEASE", "CAP_AUDIT_WRITE", "CAP_AUDIT_CONTROL", "CAP_SETFCAP", "CAP_MAC_OVERRIDE",
+	"CAP_MAC_ADMIN", "CAP_SYSLOG", "CAP_WAKE_ALARM", "CAP_BLOCK_SUSPEND", "CAP_AUDIT_READ",
+	"CAP_PERFMON", "CAP_BPF", "CAP_CHECKPOINT_RESTORE"}
+
+// seccompArches maps each supported GOARCH to its AUDIT_ARCH value and the numbers of the system
+// calls which SeccompDefault denies.
+var seccompArches = map[string]struct {
+	audit    uint32
+	x32      bool
+	syscalls []uint32
+}{
+	"amd64": {0xc000003e, true, []uint32{101, 103, 155, 159, 163, 164, 165, 166, 167, 168, 169,
+		172, 173, 175, 176, 179, 212, 227, 246, 248, 249, 250, 272, 298, 304, 305, 308, 310, 311,
+		313, 320, 321, 323, 428, 429, 430, 432}},
+	"arm64": {0xc00000b7, false, []uint32{18, 39, 40, 41, 60, 89, 97, 104, 105, 106, 112, 116,
+		117, 142, 170, 171, 217, 218, 219, 224, 225, 241, 265, 266, 268, 270, 271, 273, 280, 282,
+		294, 428, 429, 430, 432}},
+}
+
+// A Sandbox isolates a task's processes from the rest of the host. Options which the host does
+// not support are skipped, and the reason is logged to the task's backlog.
+type Sandbox struct {
+	// MountNamespace, PIDNamespace, and IPCNamespace run the task in new namespaces.
+	// In a PID namespace, the task's command is process 1, so it only receives SIGTERM if it
+	// handles it.
+	MountNamespace bool
+	PIDNamespace   bool
+	IPCNamespace   bool
+
+	// ReadOnlyPaths are made read-only for the task. They require MountNamespace.
+	ReadOnlyPaths []string
+
+	// PrivateTmp gives the task its own empty /tmp. It requires MountNamespace.
+	PrivateTmp bool
+
+	// NoNewPrivs stops the task from gaining privileges through setuid programs.
+	NoNewPrivs bool
+
+	// DropCapabilities removes every capability except those in Capabilities, which are names
+	// such as "CAP_NET_BIND_SERVICE".
+	DropCapabilities bool
+	Capabilities     []string
+
+	// Seccomp is "" for no seccomp filter or SeccompDefault. A filter implies NoNewPrivs.
+	Seccomp string
+}
+
+// Validate returns an error if the Sandbox is invalid.
+func (s *Sandbox) Validate() error {
+	if (len(s.ReadOnlyPaths) > 0 || s.PrivateTmp) && !s.MountNamespace {
+		return errors.New("read-only paths and private /tmp need a mount namespace")
+	}
+	for _, path := range s.ReadOnlyPaths {
+		if !filepath.IsAbs(path) {
+			return errors.New("read-only path must be absolute: " + path)
+		}
+	}
+	for _, name := range s.Capabilities {
+		if capabilityNumber(name) < 0 {
+			return errors.New("unknown capability: " + name)
+		}
+	}
+	if s.Seccomp != "" && s.Seccomp != SeccompDefault {
+		return errors.New("unknown seccomp profile: " + s.Seccomp)
+	}
+	return nil
+}
+
+func capabilityNumber(name string) int {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+	for i, capName := range capabilityNames {
+		if capName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// A sandboxSpec tells the exec helper how to sandbox a command.
+type sandboxSpec struct {
+	Sandbox Sandbox
+
+	// Mounts and NewPID are set if the helper is in new mount and PID namespaces.
+	Mounts bool
+	NewPID bool
+
+	// Credential is applied by the helper after it sets up the sandbox, since setting up the
+	// sandbox may need privileges which the credential would drop.
+	Credential *syscall.Credential
+}
+
+var namespaceSupport = struct {
+	lock    sync.Mutex
+	results map[uintptr]error
+}{results: map[uintptr]error{}}
+
+// checkNamespace returns an error if goule cannot create a kind of namespace.
+// It runs the exec helper without a command in the namespace to find out.
+func checkNamespace(flag uintptr) error {
+	namespaceSupport.lock.Lock()
+	defer namespaceSupport.lock.Unlock()
+	if err, ok := namespaceSupport.results[flag]; ok {
+		return err
+	}
+	self, err := os.Executable()
+	if err == nil {
+		cmd := exec.Command(self, execHelperArg)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: flag}
+		err = cmd.Run()
+	}
+	namespaceSupport.results[flag] = err
+	return err
+}
+
+// sandboxCommand prepares a command which runs through the exec helper to apply the task's
+// sandbox. It returns the spec to pass to the helper.
+func (t *Task) sandboxCommand(replica int, cmd *exec.Cmd) *sandboxSpec {
+	spec := &sandboxSpec{Sandbox: *t.Sandbox, Credential: cmd.SysProcAttr.Credential}
+	cmd.SysProcAttr.Credential = nil
+
+	namespaces := []struct {
+		enabled bool
+		flag    uintptr
+		name    string
+	}{
+		{t.Sandbox.MountNamespace, syscall.CLONE_NEWNS, "mount"},
+		{t.Sandbox.PIDNamespace, syscall.CLONE_NEWPID, "PID"},
+		{t.Sandbox.IPCNamespace, syscall.CLONE_NEWIPC, "IPC"},
+	}
+	for _, ns := range namespaces {
+		if !ns.enabled {
+			continue
+		}
+		if err := checkNamespace(ns.flag); err != nil {
+			t.pushReplicaBacklog(replica, BacklogLineStatus, "Sandbox: cannot create "+
+				ns.name+" namespace ("+err.Error()+"); running without it.")
+			continue
+		}
+		cmd.SysProcAttr.Cloneflags |= ns.flag
+	}
+	spec.Mounts = cmd.SysProcAttr.Cloneflags&syscall.CLONE_NEWNS != 0
+	spec.NewPID = cmd.SysProcAttr.Cloneflags&syscall.CLONE_NEWPID != 0
+	if !spec.Mounts && (len(t.Sandbox.ReadOnlyPaths) > 0 || t.Sandbox.PrivateTmp) {
+		t.pushReplicaBacklog(replica, BacklogLineStatus, "Sandbox: read-only paths and "+
+			"private /tmp need a mount namespace; running without them.")
+	}
+	return spec
+}
+
+// encodeSandboxSpec encodes a spec for the exec helper's environment.
+func encodeSandboxSpec(spec *sandboxSpec) string {
+	data, _ := json.Marshal(spec)
+	return string(data)
+}
+
+// applySandbox sets up the sandbox in the exec helper. Steps which fail are reported on stderr,
+// which is the task's backlog, and skipped. The helper must be locked to its OS thread, since
+// some of the settings only apply to the calling thread and are inherited through exec.
+func applySandbox(encoded string) error {
+	if encoded == "" {
+		return nil
+	}
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(encoded), &spec); err != nil {
+		return err
+	}
+	s := spec.Sandbox
+	warn := func(step string, err error) {
+		os.Stderr.WriteString("goule: sandbox: " + step + ": " + err.Error() + "\n")
+	}
+
+	if spec.Mounts {
+		if err := setupMounts(&spec, warn); err != nil {
+			warn("mount namespace", err)
+		}
+	}
+
+	if s.DropCapabilities && syscall.Geteuid() == 0 {
+		if err := dropCapabilities(s.Capabilities); err != nil {
+			warn("dropping capabilities", err)
+		}
+	}
+
+	if cred := spec.Credential; cred != nil {
+		if !cred.NoSetGroups {
+			if err := syscall.Setgroups(intSlice(cred.Groups)); err != nil {
+				return err
+			}
+		}
+		if err := syscall.Setgid(int(cred.Gid)); err != nil {
+			return err
+		}
+		if err := syscall.Setuid(int(cred.Uid)); err != nil {
+			return err
+		}
+	}
+
+	if s.NoNewPrivs || s.Seccomp != "" {
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0,
+			0); errno != 0 {
+			warn("no_new_privs", errno)
+		}
+	}
+	if s.Seccomp == SeccompDefault {
+		if err := loadSeccompFilter(); err != nil {
+			warn("seccomp", err)
+		}
+	}
+	return nil
+}
+
+func setupMounts(spec *sandboxSpec, warn func(string, error)) error {
+	// Keep the task's mounts from propagating back to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+	if spec.NewPID {
+		if err := syscall.Mount("proc", "/proc", "proc", 0, ""); err != nil {
+			warn("mounting /proc", err)
+		}
+	}
+	if spec.Sandbox.PrivateTmp {
+		if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", 0, "mode=1777"); err != nil {
+			warn("private /tmp", err)
+		}
+	}
+	for _, path := range spec.Sandbox.ReadOnlyPaths {
+		err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, "")
+		if err == nil {
+			err = syscall.Mount("", path, "", syscall.MS_BIND|syscall.MS_REMOUNT|
+				syscall.MS_RDONLY, "")
+		}
+		if err != nil {
+			warn("making "+path+" read-only", err)
+		}
+	}
+	return nil
+}
+
+// dropCapabilities removes every capability which is not allowed from the bounding set, so that
+// the command does not receive it when it is executed.
+func dropCapabilities(allowed []string) error {
+	keep := map[int]bool{}
+	for _, name := range allowed {
+		keep[capabilityNumber(name)] = true
+	}
+	last := len(capabilityNames) - 1
+	if data, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			last = n
+		}
+	}
+	for i := 0; i <= last; i++ {
+		if keep[i] {
+			continue
+		}
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapbsetDrop, uintptr(i), 0, 0,
+			0, 0)
+		if errno != 0 && errno != syscall.EINVAL {
+			return errno
+		}
+	}
+	return nil
+}
+
+// loadSeccompFilter installs the SeccompDefault filter.
+func loadSeccompFilter() error {
+	arch, ok := seccompArches[runtime.GOARCH]
+	if !ok {
+		return errors.New("not supported on " + runtime.GOARCH)
+	}
+
+	const (
+		ldAbs = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+		jeq   = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+		jge   = syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K
+		ret   = syscall.BPF_RET | syscall.BPF_K
+	)
+	deny := uint32(seccompRetErrno | uint32(syscall.EPERM))
+	n := len(arch.syscalls)
+
+	// Check the architecture, then compare the system call number against each denied call.
+	filter := []syscall.SockFilter{
+		{Code: ldAbs, K: 4},
+		{Code: jeq, Jt: 1, K: arch.audit},
+		{Code: ret, K: deny},
+		{Code: ldAbs, K: 0},
+	}
+	if arch.x32 {
+		// The x32 ABI numbers its system calls from 0x40000000.
+		filter = append(filter, syscall.SockFilter{Code: jge, Jt: uint8(n + 1), K: 0x40000000})
+	}
+	for i, nr := range arch.syscalls {
+		filter = append(filter, syscall.SockFilter{Code: jeq, Jt: uint8(n - i), K: nr})
+	}
+	filter = append(filter, syscall.SockFilter{Code: ret, K: seccompRetAllow},
+		syscall.SockFilter{Code: ret, K: deny})
+
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter,
+		uintptr(unsafe.Pointer(&prog)), 0, 0, 0)
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func intSlice(values []uint32) []int {
+	res := make([]int, len(values))
+	for i, value := range values {
+		res[i] = int(value)
+	}
+	return res
+}
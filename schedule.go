@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OverlapSkip  = "skip"
+	OverlapQueue = "queue"
+	OverlapKill  = "kill"
+)
+
+// maxScheduleYears is how far ahead a schedule searches for its next run before giving up, as
+// happens for expressions like "0 0 30 2 *".
+const maxScheduleYears = 5
+
+// A schedule decides when a scheduled task runs.
+type schedule interface {
+	// Next returns the first run time after t, or the zero time if there is none.
+	Next(t time.Time) time.Time
+}
+
+// parseSchedule parses a cron expression, a macro like "@daily", or an "@every" duration like
+// "@every 1h30m". Cron expressions have five fields: minute, hour, day of month, month, and day
+// of week. Fields may use "*", lists, ranges, steps, and English names for months and days.
+// Times are computed in the given location.
+func parseSchedule(spec string, loc *time.Location) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil {
+			return nil, err
+		}
+		if interval < time.Second {
+			return nil, errors.New("schedule interval must be at least one second")
+		}
+		return everySchedule(interval), nil
+	}
+	macros := map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+	if expanded, ok := macros[spec]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expressions must have five fields: " + spec)
+	}
+	res := &cronSchedule{loc: loc}
+	var err error
+	if res.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if res.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if res.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	months := []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct",
+		"nov", "dec"}
+	if res.month, err = parseCronField(fields[3], 1, 12, months); err != nil {
+		return nil, err
+	}
+	days := []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+	if res.dow, err = parseCronField(fields[4], 0, 7, days); err != nil {
+		return nil, err
+	}
+	if res.dow[7] {
+		// Both 0 and 7 mean Sunday.
+		res.dow[0] = true
+	}
+	res.domAny = strings.HasPrefix(fields[2], "*")
+	res.dowAny = strings.HasPrefix(fields[4], "*")
+	return res, nil
+}
+
+// parseCronField parses one field of a cron expression into a set of allowed values.
+// Names, if non-nil, are the names of the values starting at min.
+func parseCronField(field string, min, max int, names []string) ([]bool, error) {
+	res := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step < 1 {
+				return nil, errors.New("invalid step in cron field: " + field)
+			}
+			rangePart = part[:idx]
+		}
+
+		var start, end int
+		if rangePart == "*" {
+			start, end = min, max
+		} else if idx := strings.Index(rangePart, "-"); idx >= 0 {
+			var err1, err2 error
+			start, err1 = parseCronValue(rangePart[:idx], min, max, names)
+			end, err2 = parseCronValue(rangePart[idx+1:], min, max, names)
+			if err1 != nil || err2 != nil || end < start {
+				return nil, errors.New("invalid range in cron field: " + field)
+			}
+		} else {
+			value, err := parseCronValue(rangePart, min, max, names)
+			if err != nil {
+				return nil, err
+			}
+			start, end = value, value
+			if step > 1 {
+				end = max
+			}
+		}
+		for i := start; i <= end; i += step {
+			res[i] = true
+		}
+	}
+	return res, nil
+}
+
+func parseCronValue(value string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(value, name) {
+			return min + i, nil
+		}
+	}
+	num, err := strconv.Atoi(value)
+	if err != nil || num < min || num > max {
+		return 0, errors.New("invalid value in cron field: " + value)
+	}
+	return num, nil
+}
+
+// An everySchedule runs at a fixed interval.
+type everySchedule time.Duration
+
+func (e everySchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// A cronSchedule runs at the times matched by a cron expression.
+type cronSchedule struct {
+	loc *time.Location
+
+	minute, hour, dom, month, dow []bool
+
+	// domAny and dowAny record whether the day fields start with "*", as "*" and "*/2" do. As
+	// in cron, if both day fields are restricted, a day matches if either field does.
+	domAny, dowAny bool
+}
+
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + maxScheduleYears
+	for t.Year() <= limit {
+		var next time.Time
+		if !c.month[t.Month()] {
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+		} else if !c.dayMatches(t) {
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+		} else if !c.hour[t.Hour()] {
+			next = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+		} else if !c.minute[t.Minute()] {
+			next = t.Add(time.Minute)
+		} else {
+			return t
+		}
+		if !next.After(t) {
+			// Daylight saving time can make a wall clock time repeat.
+			next = t.Truncate(time.Hour).Add(time.Hour)
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom[t.Day()]
+	dowMatch := c.dow[t.Weekday()]
+	if c.domAny || c.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// loadScheduleLocation returns the time zone for a task's schedule. The empty string means the
+// server's local time.
+func loadScheduleLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// ScheduleTimes returns the time at which a scheduled task was last started by its schedule, and
+// the time at which it will next be started. Either may be the zero time.
+func (t *Task) ScheduleTimes() (last, next time.Time) {
+	t.scheduleLock.Lock()
+	defer t.scheduleLock.Unlock()
+	return t.lastRun, t.nextRun
+}
+
+// scheduleLoop starts the task according to its schedule until the stop channel is closed.
+func (t *Task) scheduleLoop(sched schedule, stop <-chan struct{}) {
+	// queue is non-nil while a run is waiting for the previous run to finish.
+	var queue *time.Ticker
+	defer func() {
+		if queue != nil {
+			queue.Stop()
+		}
+	}()
+
+	for {
+		next := t.setNextRun(sched.Next(time.Now()))
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			fire = timer.C
+		}
+
+	Wait:
+		for {
+			var poll <-chan time.Time
+			if queue != nil {
+				poll = queue.C
+			}
+			select {
+			case <-stop:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			case <-poll:
+				if t.Status() == TaskStatusStopped {
+					queue.Stop()
+					queue = nil
+					t.startScheduledRun()
+				}
+			case <-fire:
+				break Wait
+			}
+		}
+
+		if t.Status() == TaskStatusStopped {
+			t.startScheduledRun()
+			continue
+		}
+		switch t.Overlap {
+		case OverlapQueue:
+			if queue == nil {
+				t.pushBacklog(BacklogLineStatus, "Previous run is active; queued next run.")
+				queue = time.NewTicker(time.Second)
+			}
+		case OverlapKill:
+			t.pushBacklog(BacklogLineStatus, "Previous run is active; stopping it.")
+			t.Stop()
+			t.startScheduledRun()
+		default:
+			t.pushBacklog(BacklogLineStatus, "Previous run is active; skipped run.")
+		}
+	}
+}
+
+func (t *Task) setNextRun(next time.Time) time.Time {
+	t.scheduleLock.Lock()
+	defer t.scheduleLock.Unlock()
+	t.nextRun = next
+	return next
+}
+
+func (t *Task) startScheduledRun() {
+	t.scheduleLock.Lock()
+	t.lastRun = time.Now()
+	t.scheduleLock.Unlock()
+	t.pushBacklog(BacklogLineStatus, "Starting scheduled run.")
+	t.Start()
+}
+
+// scheduleLabel describes when a scheduled task last ran and will next run, in the task's time
+// zone. It returns "" for tasks without a schedule.
+func scheduleLabel(t *Task) string {
+	if t.Schedule == "" {
+		return ""
+	}
+	loc, err := loadScheduleLocation(t.TimeZone)
+	if err != nil {
+		loc = time.Local
+	}
+	format := func(tm time.Time, none string) string {
+		if tm.IsZero() {
+			return none
+		}
+		return tm.In(loc).Format("Jan 2 15:04 MST")
+	}
+	last, next := t.ScheduleTimes()
+	return "Last run: " + format(last, "never") + " · Next run: " + format(next, "none")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * foo *",
+		"@every 10ms",
+		"@every soon",
+		"@fortnightly",
+	} {
+		if _, err := parseSchedule(spec, time.UTC); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	start := time.Date(2024, time.January, 31, 10, 30, 15, 0, time.UTC) // A Wednesday.
+	tests := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 31, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 31, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2024, 1, 31, 13, 0, 0, 0, time.UTC)},
+		{"0,30 8 * * *", time.Date(2024, 2, 1, 8, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * jun-aug mon", time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * FRI", time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC)},
+
+		// When both day fields are restricted, either may match.
+		{"0 0 15 * fri", time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * sat", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+
+		// A day field with a "*" step does not widen the other field.
+		{"0 0 */2 * fri", time.Date(2024, 2, 9, 0, 0, 0, 0, time.UTC)},
+		{"0 0 15 * */2", time.Date(2024, 2, 15, 0, 0, 0, 0, time.UTC)},
+
+		{"@every 90m", start.Add(90 * time.Minute)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		sched, err := parseSchedule(test.spec, time.UTC)
+		if err != nil {
+			t.Errorf("%q: %s", test.spec, err)
+			continue
+		}
+		if actual := sched.Next(start); !actual.Equal(test.expected) {
+			t.Errorf("%q: expected %v but got %v", test.spec, test.expected, actual)
+		}
+	}
+}
+
+func TestScheduleNextLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+5", 5*60*60)
+	sched, err := parseSchedule("0 9 * * *", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 5, 0, 0, 0, time.UTC)
+	expected := time.Date(2024, 1, 2, 4, 0, 0, 0, time.UTC)
+	if actual := sched.Next(start); !actual.Equal(expected) {
+		t.Errorf("expected %v but got %v", expected, actual)
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"github.com/gorilla/context"
 	"github.com/unixpickle/ezserver"
-	"github.com/unixpickle/reverseproxy"
 )
 
 // A Server contains all the HTTP servers and the proxy object for a Goule instance.
@@ -11,7 +10,7 @@ type Server struct {
 	Control *ezserver.HTTP
 	HTTP    *ezserver.HTTP
 	HTTPS   *ezserver.HTTPS
-	Proxy   *reverseproxy.Proxy
+	Proxy   *Proxy
 }
 
 // NewServer creates a server based on a configuration.
@@ -26,7 +25,9 @@ func NewServer(cfg *Config, adminPort int) (*Server, error) {
 
 	// Create server-related objects.
 	res.Control = ezserver.NewHTTP(context.ClearHandler(Control{cfg, res}))
-	res.Proxy = reverseproxy.NewProxy(cfg.Rules)
+	res.Proxy = NewProxy(cfg.Rules, cfg.AccessLog)
+	res.Proxy.SetTrustedProxies(cfg.TrustedProxies)
+	TaskTargets.Watch(res.Proxy.SetTaskTargets)
 	res.HTTP = ezserver.NewHTTP(res.Proxy)
 	res.HTTPS = ezserver.NewHTTPS(res.Proxy, cfg.TLS.TLS)
 	res.HTTP.SetSecurityRedirects(cfg.TLS.Redirects)
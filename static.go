@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A StaticSite serves files from a local directory instead of forwarding requests to targets.
+type StaticSite struct {
+	// Root is the absolute path of the directory to serve.
+	Root string
+
+	// Index lists the files which are served for directory requests, in order of preference.
+	// If it is empty, "index.html" is used.
+	Index []string
+
+	// SPA causes requests for missing files to be answered with the root index file, as is
+	// needed by single-page applications which do their own routing.
+	SPA bool
+
+	// CacheControl, if non-empty, is sent as the Cache-Control header of every file.
+	CacheControl string
+
+	// Precompressed causes "file.br" or "file.gz" to be served in place of "file" when it exists
+	// and the client accepts the encoding.
+	Precompressed bool
+
+	// Listing enables listings for directories without an index file.
+	Listing bool
+}
+
+// Copy returns a deep copy of the StaticSite.
+func (s *StaticSite) Copy() *StaticSite {
+	res := *s
+	res.Index = append([]string{}, s.Index...)
+	return &res
+}
+
+// Validate returns an error if the StaticSite is invalid.
+func (s *StaticSite) Validate() error {
+	if !filepath.IsAbs(s.Root) {
+		return errors.New("static root must be an absolute path: " + s.Root)
+	}
+	for _, index := range s.Index {
+		if index == "" || strings.ContainsAny(index, "/\\") {
+			return errors.New("invalid index file: " + index)
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves a file, index file, or directory listing from the site.
+func (s *StaticSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	urlPath := path.Clean("/" + r.URL.Path)
+	localPath := filepath.Join(s.Root, filepath.FromSlash(urlPath))
+	info, err := os.Stat(localPath)
+	if err != nil {
+		if os.IsNotExist(err) && s.SPA {
+			s.serveSPAIndex(w, r)
+		} else if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+		}
+		return
+	}
+
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := url.URL{Path: path.Base(urlPath) + "/", RawQuery: r.URL.RawQuery}
+			if urlPath == "/" {
+				target.Path = "/"
+			}
+			http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+			return
+		}
+		if index := s.findIndex(localPath); index != "" {
+			s.serveFile(w, r, index)
+		} else if s.Listing {
+			serveListing(w, localPath, urlPath)
+		} else if s.SPA {
+			s.serveSPAIndex(w, r)
+		} else {
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+		}
+		return
+	}
+
+	s.serveFile(w, r, localPath)
+}
+
+func (s *StaticSite) indexNames() []string {
+	if len(s.Index) == 0 {
+		return []string{"index.html"}
+	}
+	return s.Index
+}
+
+// findIndex returns the path of the first index file in a directory, or "" if there is none.
+func (s *StaticSite) findIndex(dir string) string {
+	for _, name := range s.indexNames() {
+		indexPath := filepath.Join(dir, name)
+		if info, err := os.Stat(indexPath); err == nil && !info.IsDir() {
+			return indexPath
+		}
+	}
+	return ""
+}
+
+func (s *StaticSite) serveSPAIndex(w http.ResponseWriter, r *http.Request) {
+	if index := s.findIndex(s.Root); index != "" {
+		s.serveFile(w, r, index)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func (s *StaticSite) serveFile(w http.ResponseWriter, r *http.Request, localPath string) {
+	servePath := localPath
+	if s.Precompressed {
+		w.Header().Add("Vary", "Accept-Encoding")
+		for _, encoding := range []struct{ name, ext string }{{"br", ".br"}, {"gzip", ".gz"}} {
+			if !acceptsEncoding(r, encoding.name) {
+				continue
+			}
+			if info, err := os.Stat(localPath + encoding.ext); err == nil && !info.IsDir() {
+				servePath = localPath + encoding.ext
+				w.Header().Set("Content-Encoding", encoding.name)
+				break
+			}
+		}
+	}
+
+	f, err := os.Open(servePath)
+	if err != nil {
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The type must come from the uncompressed file's name.
+	if mimeType := mime.TypeByExtension(filepath.Ext(localPath)); mimeType != "" {
+		w.Header().Set("Content-Type", mimeType)
+	}
+	if s.CacheControl != "" {
+		w.Header().Set("Cache-Control", s.CacheControl)
+	}
+	http.ServeContent(w, r, filepath.Base(localPath), info.ModTime(), f)
+}
+
+// serveListing writes an HTML listing of a directory.
+func serveListing(w http.ResponseWriter, dir, urlPath string) {
+	f, err := os.Open(dir)
+	if err != nil {
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+
+	title := html.EscapeString(urlPath)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte("<!doctype html>\n<html><head><title>" + title + "</title></head><body>\n" +
+		"<h1>" + title + "</h1>\n<ul>\n"))
+	if urlPath != "/" {
+		w.Write([]byte("<li><a href=\"../\">../</a></li>\n"))
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() {
+			name += "/"
+		}
+		link := url.URL{Path: name}
+		w.Write([]byte("<li><a href=\"" + html.EscapeString(link.String()) + "\">" +
+			html.EscapeString(name) + "</a></li>\n"))
+	}
+	w.Write([]byte("</ul>\n</body></html>\n"))
+}
+
+// acceptsEncoding returns whether a request's Accept-Encoding header allows an encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, header := range r.Header["Accept-Encoding"] {
+		for _, item := range strings.Split(header, ",") {
+			parts := strings.Split(item, ";")
+			if !strings.EqualFold(strings.TrimSpace(parts[0]), encoding) {
+				continue
+			}
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+						return false
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultStopTimeout is the number of seconds a task's processes have to exit after the stop
+	// signal if the task does not set StopTimeout.
+	defaultStopTimeout = 1
+
+	// defaultPreStopTimeout is the number of seconds a pre-stop hook may run if it does not set
+	// its Timeout.
+	defaultPreStopTimeout = 10
+)
+
+// errTaskNotRunning is the result of signaling a task which is not running.
+var errTaskNotRunning = errors.New("task is not running")
+
+// signalNames are the signals which can be sent to a task by name.
+var signalNames = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGKILL":  syscall.SIGKILL,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGCONT":  syscall.SIGCONT,
+	"SIGSTOP":  syscall.SIGSTOP,
+	"SIGTSTP":  syscall.SIGTSTP,
+	"SIGWINCH": syscall.SIGWINCH,
+}
+
+// parseSignal parses a signal name such as "SIGHUP" or "hup", or a signal number.
+func parseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if num, err := strconv.Atoi(name); err == nil && num > 0 && num < 65 {
+		return syscall.Signal(num), nil
+	}
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+	return 0, errors.New("unknown signal: " + name)
+}
+
+// A StopHook runs before a task's processes are sent their stop signal, so that the task can
+// shut down cleanly. It either runs a command or makes an HTTP GET request.
+type StopHook struct {
+	// Command is a shell command line, which is run like the task's own command.
+	Command string
+
+	// URL is requested with GET. The placeholder "{port}" is replaced with the port in the
+	// task's PORT environment variable.
+	URL string
+
+	// Timeout is the number of seconds after which the hook is abandoned and the task is sent
+	// its stop signal anyway. If it is 0, defaultPreStopTimeout is used.
+	Timeout int
+}
+
+// Validate returns an error if the StopHook is invalid.
+func (s *StopHook) Validate() error {
+	if (s.Command == "") == (s.URL == "") {
+		return errors.New("stop hook needs either a command or a URL")
+	}
+	if s.Timeout < 0 {
+		return errors.New("stop hook timeout must not be negative")
+	}
+	return nil
+}
+
+func (s *StopHook) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return time.Second * defaultPreStopTimeout
+	}
+	return time.Second * time.Duration(s.Timeout)
+}
+
+// Signal sends a signal to the process group of every running replica of the task.
+func (t *Task) Signal(sig syscall.Signal) error {
+	resp := make(chan interface{})
+	t.actions <- taskAction{action: taskActionSignal, signal: sig, resp: resp}
+	if err, ok := (<-resp).(error); ok {
+		return err
+	}
+	return nil
+}
+
+// validateStop returns an error if the task's stop settings are invalid.
+func (t *Task) validateStop() error {
+	if t.StopSignal != "" {
+		if _, ok := map[string]bool{"SIGINT": true, "SIGQUIT": true,
+			"SIGTERM": true}[t.StopSignal]; !ok {
+			return errors.New("invalid stop signal: " + t.StopSignal)
+		}
+	}
+	if t.StopTimeout < 0 {
+		return errors.New("stop timeout must not be negative")
+	}
+	if t.PreStop != nil {
+		return t.PreStop.Validate()
+	}
+	return nil
+}
+
+func (t *Task) stopSignal() syscall.Signal {
+	if sig, ok := signalNames[t.StopSignal]; ok {
+		return sig
+	}
+	return syscall.SIGTERM
+}
+
+func (t *Task) stopTimeout() time.Duration {
+	if t.StopTimeout == 0 {
+		return time.Second * defaultStopTimeout
+	}
+	return time.Second * time.Duration(t.StopTimeout)
+}
+
+// signalCommand sends a signal to the process group of a command.
+func signalCommand(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.Process == nil {
+		return errTaskNotRunning
+	}
+	pgid, err := syscall.Getpgid(cmd.Process.Pid)
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(-pgid, sig)
+}
+
+// sendSignal answers a taskActionSignal for a replica's running command.
+func (t *Task) sendSignal(replica int, cmd *exec.Cmd, val taskAction) {
+	err := signalCommand(cmd, val.signal)
+	if err == nil {
+		t.pushReplicaBacklog(replica, BacklogLineStatus, "Sent "+signalName(val.signal)+".")
+	}
+	val.resp <- err
+}
+
+func signalName(sig syscall.Signal) string {
+	for name, s := range signalNames {
+		if s == sig {
+			return name
+		}
+	}
+	return "signal " + strconv.Itoa(int(sig))
+}
+
+// terminateCommand stops a replica's process group. It runs the task's pre-stop hook, sends the
+// stop signal, and sends SIGKILL if the group has not exited after the stop timeout.
+//
+// While it waits, other actions are answered as though the replica were still running, and
+// further stop actions are answered once the group has exited. Actions may be nil.
+func (t *Task) terminateCommand(replica, port int, cmd *exec.Cmd, killChan <-chan struct{},
+	actions <-chan taskAction) {
+	var stops []chan<- interface{}
+	defer func() {
+		for _, resp := range stops {
+			close(resp)
+		}
+	}()
+
+	// wait returns true if the group exits or the event happens before the timeout.
+	wait := func(timeout time.Duration, event <-chan struct{}) bool {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-killChan:
+				return true
+			case <-event:
+				return true
+			case <-timer.C:
+				return false
+			case val, ok := <-actions:
+				if !ok {
+					actions = nil
+				} else if val.action == taskActionStop {
+					stops = append(stops, val.resp)
+				} else if val.action == taskActionStatus {
+					val.resp <- TaskStatusRunning
+				} else if val.action == taskActionSignal {
+					t.sendSignal(replica, cmd, val)
+				} else {
+					close(val.resp)
+				}
+			}
+		}
+	}
+	exited := func() bool {
+		select {
+		case <-killChan:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if t.PreStop != nil {
+		t.pushReplicaBacklog(replica, BacklogLineStatus, "Running pre-stop hook.")
+		hook := t.startPreStop(replica, port)
+		wait(t.PreStop.timeout(), hook.done)
+		hook.finish(!exited())
+		if exited() {
+			return
+		}
+	}
+
+	sig := t.stopSignal()
+	if err := signalCommand(cmd, sig); err == nil {
+		if wait(t.stopTimeout(), nil) {
+			return
+		}
+		t.pushReplicaBacklog(replica, BacklogLineStatus, "Process group did not respond to "+
+			signalName(sig)+".")
+
+		signalCommand(cmd, syscall.SIGKILL)
+		if wait(time.Second, nil) {
+			return
+		}
+	}
+	t.pushReplicaBacklog(replica, BacklogLineStatus, "Process group could not be terminated.")
+	cmd.Process.Kill()
+}
+
+// A preStopRun is a running pre-stop hook.
+type preStopRun struct {
+	task    *Task
+	replica int
+
+	// done is closed when the hook finishes, after which err and output are set.
+	done   chan struct{}
+	err    error
+	output bytes.Buffer
+
+	cmd *exec.Cmd
+}
+
+// startPreStop starts the task's pre-stop hook for a replica.
+func (t *Task) startPreStop(replica, port int) *preStopRun {
+	hook := t.PreStop
+	run := &preStopRun{task: t, replica: replica, done: make(chan struct{})}
+	if hook.Command == "" {
+		url := strings.Replace(hook.URL, "{port}", strconv.Itoa(port), -1)
+		go func() {
+			defer close(run.done)
+			client := http.Client{Timeout: hook.timeout()}
+			resp, err := client.Get(url)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode >= 400 {
+					err = errors.New("status " + strconv.Itoa(resp.StatusCode))
+				}
+			}
+			run.err = err
+		}()
+		return run
+	}
+
+	cmd, err := t.shellCommand(replica, port, hook.Command)
+	if err == nil {
+		run.cmd = cmd
+		cmd.Stdout = &run.output
+		cmd.Stderr = &run.output
+		err = t.startCommand(replica, cmd)
+	}
+	if err != nil {
+		run.err = err
+		close(run.done)
+	} else {
+		go func() {
+			run.err = run.cmd.Wait()
+			close(run.done)
+		}()
+	}
+	return run
+}
+
+// finish logs the result of the hook if it has finished, or kills it if it is still running.
+// A hook which is still running is reported as timed out if timedOut is set.
+func (p *preStopRun) finish(timedOut bool) {
+	select {
+	case <-p.done:
+	default:
+		if p.cmd != nil {
+			signalCommand(p.cmd, syscall.SIGKILL)
+		}
+		if timedOut {
+			p.task.pushReplicaBacklog(p.replica, BacklogLineStatus, "Pre-stop hook timed out.")
+		}
+		return
+	}
+	for _, line := range strings.Split(strings.TrimRight(p.output.String(), "\n"), "\n") {
+		if line != "" {
+			p.task.pushReplicaBacklog(p.replica, BacklogLineStdout, line)
+		}
+	}
+	if p.err != nil {
+		p.task.pushReplicaBacklog(p.replica, BacklogLineStatus,
+			"Pre-stop hook failed: "+p.err.Error()+".")
+	}
+}
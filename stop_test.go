@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStopHookJSON(t *testing.T) {
+	tests := []struct {
+		data string
+		hook StopHook
+	}{
+		{`{"Command":"kill -USR1 $PID","Timeout":5}`,
+			StopHook{Command: "kill -USR1 $PID", Timeout: 5}},
+		{`{"URL":"http://127.0.0.1:{port}/drain","Command":null}`,
+			StopHook{URL: "http://127.0.0.1:{port}/drain"}},
+	}
+	for _, test := range tests {
+		var hook StopHook
+		if err := json.Unmarshal([]byte(test.data), &hook); err != nil {
+			t.Errorf("%s: %s", test.data, err)
+		} else if hook != test.hook {
+			t.Errorf("%s: expected %+v but got %+v", test.data, test.hook, hook)
+		}
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	tests := map[string]string{
+		"SIGHUP": "SIGHUP",
+		"hup":    "SIGHUP",
+		" term ": "SIGTERM",
+		"9":      "SIGKILL",
+	}
+	for name, expected := range tests {
+		sig, err := parseSignal(name)
+		if err != nil {
+			t.Errorf("%q: %s", name, err)
+		} else if signalName(sig) != expected {
+			t.Errorf("%q: expected %s but got %s", name, expected, signalName(sig))
+		}
+	}
+	for _, name := range []string{"", "SIGFOO", "0", "65"} {
+		if _, err := parseSignal(name); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"os/exec"
+	"sort"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -12,6 +15,7 @@ const (
 	taskActionStart  = iota
 	taskActionStop   = iota
 	taskActionStatus = iota
+	taskActionSignal = iota
 )
 
 const (
@@ -39,6 +43,9 @@ type BacklogLine struct {
 
 	// Time is the UNIX timestamp in milliseconds when the message was logged.
 	Time int64
+
+	// Replica is the index of the replica which logged the message.
+	Replica int
 }
 
 // A Task runs an executable in the background. Tasks each have their own background loop.
@@ -56,8 +63,114 @@ type Task struct {
 	SetUID   bool
 	ID       int64
 
+	// User and Group, if non-empty, are the names of the user and group which the task runs as.
+	// They override UID and GID. A user's supplementary groups are looked up as well, and its
+	// home directory and name are passed in the HOME, USER, and LOGNAME environment variables.
+	User  string
+	Group string
+
+	// InheritEnv decides which of goule's environment variables the task's commands receive:
+	// InheritAll (the default), InheritNone, or InheritAllow for only those in InheritVars.
+	// An empty value is treated as InheritAll, as tasks saved by older versions inherit goule's
+	// whole environment.
+	InheritEnv  string
+	InheritVars []string
+
+	// EnvFiles are dotenv files which are read each time the task starts. Paths are relative to
+	// Dir. Their variables override inherited ones, and Env overrides them.
+	EnvFiles []string
+
+	// Replicas is the number of copies of the command which run at once. Each replica has its
+	// own backlog and restarts independently, and it receives its index in the REPLICA
+	// environment variable. Values less than 1 are treated as 1.
+	Replicas int
+
+	// Schedule, if non-empty, starts the task at the times given by a cron expression such as
+	// "30 2 * * *", a macro such as "@daily", or an interval such as "@every 10m".
+	Schedule string
+
+	// TimeZone is the IANA name of the time zone for the schedule, such as "America/New_York".
+	// The empty string means the server's local time.
+	TimeZone string
+
+	// Overlap decides what happens when a scheduled run is due while the previous run is still
+	// active. It is OverlapSkip (the default), OverlapQueue, or OverlapKill.
+	Overlap string
+
+	// Proxy, if non-nil, links the task to a proxy host.
+	Proxy *TaskProxy
+
+	// StopSignal is the signal which asks the task's processes to exit: "SIGINT", "SIGQUIT", or
+	// "SIGTERM". The empty string is equivalent to "SIGTERM".
+	StopSignal string
+
+	// StopTimeout is the number of seconds the task's processes have to exit after the stop
+	// signal before they are killed. If it is 0, defaultStopTimeout is used.
+	StopTimeout int
+
+	// PreStop, if non-nil, runs before the stop signal is sent.
+	PreStop *StopHook
+
+	// Resources, if non-nil, limits the resources which the task's processes may use.
+	Resources *ResourceLimits
+
+	// Sandbox, if non-nil, isolates the task's processes from the rest of the host.
+	Sandbox *Sandbox
+
+	// Terminal, if non-nil, runs the task's processes under a pseudo-terminal.
+	Terminal *Terminal
+
+	// PreStart, PostStart, and PostStop are shell commands which run in order, with the
+	// environment of the task. PreStart runs once each time the task is started, before any of
+	// its replicas, and if a pre-start command fails, the task does not start. Each replica runs
+	// PostStart alongside itself once it has started, and PostStop after it exits or is stopped
+	// and its post-start commands have been killed.
+	PreStart  []string
+	PostStart []string
+	PostStop  []string
+
+	// HookTimeout is the number of seconds after which a pre-start, post-start, or post-stop
+	// command is killed. If it is 0, defaultLifecycleHookTimeout is used.
+	HookTimeout int
+
+	// DependsOn lists the tasks which must be ready before this task is auto-launched.
+	// When goule stops, this task is stopped before them.
+	DependsOn []Dependency
+
+	// backlogs maps each replica to its backlog.
 	backlogLock sync.RWMutex
-	backlog     []BacklogLine
+	backlogs    map[int][]BacklogLine
+
+	// proxyAddresses maps each healthy replica to its address. While proxyRetired is set, the
+	// task's targets are not registered because a new version is replacing them.
+	proxyLock      sync.Mutex
+	proxyAddresses map[int]string
+	proxyRetired   bool
+
+	// scheduleStop stops the schedule loop, which closes scheduleDone once it has stopped.
+	scheduleLock sync.Mutex
+	lastRun      time.Time
+	nextRun      time.Time
+	scheduleStop chan struct{}
+	scheduleDone chan struct{}
+
+	// cgroup is the directory of the task's cgroup, or "" if it has none. processGroups maps each
+	// running replica to its process group, whose usage is read when there is no cgroup. The CPU
+	// sample is the task's CPU usage in microseconds when ResourceUsage was last called.
+	cgroupLock     sync.Mutex
+	cgroup         string
+	processGroups  map[int]int
+	cpuSampleTime  time.Time
+	cpuSampleUsage int64
+	cpuPercent     float64
+
+	// terminals maps each replica to its pseudo-terminal if the task has a Terminal.
+	terminalLock sync.Mutex
+	terminals    map[int]*terminalState
+
+	// deployment is the new version of the task during a blue-green deploy.
+	// It is protected by the Config's lock.
+	deployment *Task
 
 	actions chan<- taskAction
 }
@@ -68,22 +181,99 @@ func NewTask() *Task {
 	return &Task{}
 }
 
-// Backlog returns a copy of the command's backlog.
+// Backlog returns a copy of the backlog of every replica, ordered by time.
 func (t *Task) Backlog() []BacklogLine {
 	t.backlogLock.RLock()
 	defer t.backlogLock.RUnlock()
-	backlog := make([]BacklogLine, len(t.backlog))
-	for i, x := range t.backlog {
-		backlog[i] = x
+	backlog := []BacklogLine{}
+	for _, lines := range t.backlogs {
+		backlog = append(backlog, lines...)
 	}
+	sort.SliceStable(backlog, func(i, j int) bool {
+		if backlog[i].Time == backlog[j].Time {
+			return backlog[i].Replica < backlog[j].Replica
+		}
+		return backlog[i].Time < backlog[j].Time
+	})
 	return backlog
 }
 
+// Validate returns an error if the task is invalid.
+func (t *Task) Validate() error {
+	if len(t.Args) == 0 {
+		return errors.New("missing command")
+	}
+	if t.Replicas < 0 {
+		return errors.New("replicas must not be negative")
+	}
+	if _, err := t.parseSchedule(); err != nil {
+		return err
+	}
+	switch t.Overlap {
+	case "", OverlapSkip, OverlapQueue, OverlapKill:
+	default:
+		return errors.New("invalid overlap policy: " + t.Overlap)
+	}
+	if t.User != "" && t.SetUID {
+		return errors.New("set either a user or a UID")
+	}
+	if t.Group != "" && t.SetGID {
+		return errors.New("set either a group or a GID")
+	}
+	if t.Schedule != "" && t.Relaunch {
+		return errors.New("scheduled tasks cannot relaunch")
+	}
+	for _, dep := range t.DependsOn {
+		if err := dep.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := t.validateEnv(); err != nil {
+		return err
+	}
+	if err := t.validateHooks(); err != nil {
+		return err
+	}
+	if err := t.validateStop(); err != nil {
+		return err
+	}
+	if t.Resources != nil {
+		if err := t.Resources.Validate(); err != nil {
+			return err
+		}
+	}
+	if t.Sandbox != nil {
+		if err := t.Sandbox.Validate(); err != nil {
+			return err
+		}
+	}
+	if t.Terminal != nil {
+		if err := t.Terminal.Validate(); err != nil {
+			return err
+		}
+	}
+	if t.Proxy != nil {
+		return t.Proxy.Validate()
+	}
+	return nil
+}
+
+// inheritBacklog replaces the task's backlog with a copy of another task's backlog.
+func (t *Task) inheritBacklog(from *Task) {
+	backlogs := map[int][]BacklogLine{}
+	for _, line := range from.Backlog() {
+		backlogs[line.Replica] = append(backlogs[line.Replica], line)
+	}
+	t.backlogLock.Lock()
+	t.backlogs = backlogs
+	t.backlogLock.Unlock()
+}
+
 // Start begins executing a command for the task. If the task is executing, this
 // has no effect.
 func (t *Task) Start() {
 	resp := make(chan interface{})
-	t.actions <- taskAction{taskActionStart, resp}
+	t.actions <- taskAction{action: taskActionStart, resp: resp}
 	<-resp
 }
 
@@ -93,16 +283,38 @@ func (t *Task) StartLoop() {
 	if t.actions != nil {
 		panic("task's loop is already running")
 	}
+	t.setupCgroup()
 	ch := make(chan taskAction)
 	t.actions = ch
 	go t.loop(ch)
+
+	if sched, _ := t.parseSchedule(); sched != nil {
+		t.scheduleStop = make(chan struct{})
+		t.scheduleDone = make(chan struct{})
+		go func(stop <-chan struct{}, done chan<- struct{}) {
+			defer close(done)
+			t.scheduleLoop(sched, stop)
+		}(t.scheduleStop, t.scheduleDone)
+	}
+}
+
+// parseSchedule parses the task's schedule, returning nil if the task is not scheduled.
+func (t *Task) parseSchedule() (schedule, error) {
+	if t.Schedule == "" {
+		return nil, nil
+	}
+	loc, err := loadScheduleLocation(t.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	return parseSchedule(t.Schedule, loc)
 }
 
 // Status returns the task's current state. Possible values are
 // TaskStatusStopped, TaskStatusRunning, and TaskStatusRestarting.
 func (t *Task) Status() int {
 	resp := make(chan interface{})
-	t.actions <- taskAction{taskActionStatus, resp}
+	t.actions <- taskAction{action: taskActionStatus, resp: resp}
 	return (<-resp).(int)
 }
 
@@ -110,7 +322,7 @@ func (t *Task) Status() int {
 // effect. This blocks to wait for the task to stop executing.
 func (t *Task) Stop() {
 	resp := make(chan interface{})
-	t.actions <- taskAction{taskActionStop, resp}
+	t.actions <- taskAction{action: taskActionStop, resp: resp}
 	<-resp
 }
 
@@ -123,38 +335,53 @@ func (t *Task) StopLoop() {
 	if t.actions == nil {
 		panic("task's loop is not running")
 	}
+	if t.scheduleStop != nil {
+		close(t.scheduleStop)
+		<-t.scheduleDone
+		t.scheduleStop = nil
+		t.setNextRun(time.Time{})
+	}
 	t.Stop()
 	close(t.actions)
 	t.actions = nil
+	t.removeCgroup()
+	t.closeConsoles()
 }
 
-func (t *Task) cmd() *exec.Cmd {
+// cmd creates a command for a replica of the task. If port is non-zero, it is passed to the
+// command in the PORT environment variable.
+func (t *Task) cmd(replica, port int) (*exec.Cmd, error) {
+	cred, userEnv, err := t.credential()
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := t.environment(userEnv)
+	if err != nil {
+		return nil, err
+	}
+
 	task := exec.Command(t.Args[0], t.Args[1:]...)
-	for key, value := range t.Env {
-		task.Env = append(task.Env, key+"="+value)
+	task.Env = env
+	if port != 0 {
+		task.Env = append(task.Env, "PORT="+strconv.Itoa(port))
+	}
+	if t.replicaCount() > 1 {
+		task.Env = append(task.Env, "REPLICA="+strconv.Itoa(replica))
 	}
 	task.Dir = t.Dir
 
 	task.SysProcAttr = &syscall.SysProcAttr{}
 	task.SysProcAttr.Setpgid = true
-	if t.SetUID || t.SetGID {
-		task.SysProcAttr.Credential = &syscall.Credential{}
-		if t.SetUID {
-			task.SysProcAttr.Credential.Uid = uint32(t.UID)
-		} else {
-			task.SysProcAttr.Credential.Uid = uint32(syscall.Getuid())
-		}
-		if t.SetGID {
-			task.SysProcAttr.Credential.Gid = uint32(t.GID)
-		} else {
-			task.SysProcAttr.Credential.Gid = uint32(syscall.Getgid())
-		}
-	}
+	task.SysProcAttr.Credential = cred
 
-	return task
+	return task, nil
 }
 
-func (t *Task) generateStreams(cmd *exec.Cmd, doneChan <-chan struct{}) {
+func (t *Task) generateStreams(replica int, cmd *exec.Cmd, doneChan <-chan struct{}) error {
+	if t.Terminal != nil {
+		return t.generateTerminal(replica, cmd, doneChan)
+	}
 	stdoutStream := make(chan string)
 	stderrStream := make(chan string)
 	stdout := &lineForwarder{sendTo: stdoutStream}
@@ -166,9 +393,9 @@ func (t *Task) generateStreams(cmd *exec.Cmd, doneChan <-chan struct{}) {
 		for {
 			select {
 			case line := <-stdoutStream:
-				t.pushBacklog(BacklogLineStdout, line)
+				t.pushReplicaBacklog(replica, BacklogLineStdout, line)
 			case line := <-stderrStream:
-				t.pushBacklog(BacklogLineStderr, line)
+				t.pushReplicaBacklog(replica, BacklogLineStderr, line)
 			case <-doneChan:
 				break Loop
 			}
@@ -179,14 +406,15 @@ func (t *Task) generateStreams(cmd *exec.Cmd, doneChan <-chan struct{}) {
 		for {
 			select {
 			case line := <-stdoutStream:
-				t.pushBacklog(BacklogLineStdout, line)
+				t.pushReplicaBacklog(replica, BacklogLineStdout, line)
 			case line := <-stderrStream:
-				t.pushBacklog(BacklogLineStderr, line)
+				t.pushReplicaBacklog(replica, BacklogLineStderr, line)
 			default:
 				break MissedItemLoop
 			}
 		}
 	}()
+	return nil
 }
 
 func (t *Task) loop(actions <-chan taskAction) {
@@ -197,11 +425,9 @@ func (t *Task) loop(actions <-chan taskAction) {
 			val.resp <- TaskStatusStopped
 		} else if val.action == taskActionStart {
 			close(val.resp)
-			if t.Relaunch {
-				t.runRestart(actions)
-			} else {
-				t.runOnce(actions)
-			}
+			t.runReplicas(actions)
+		} else if val.action == taskActionSignal {
+			val.resp <- errTaskNotRunning
 		} else {
 			close(val.resp)
 		}
@@ -209,51 +435,243 @@ func (t *Task) loop(actions <-chan taskAction) {
 }
 
 func (t *Task) pushBacklog(typeNum int, data string) {
-	line := BacklogLine{typeNum, data, time.Now().UnixNano() / 1000000}
+	t.pushReplicaBacklog(0, typeNum, data)
+}
+
+func (t *Task) pushReplicaBacklog(replica, typeNum int, data string) {
+	line := BacklogLine{typeNum, data, time.Now().UnixNano() / 1000000, replica}
 	t.backlogLock.Lock()
-	if len(t.backlog) < MaxBacklogSize {
-		t.backlog = append(t.backlog, line)
+	if t.backlogs == nil {
+		t.backlogs = map[int][]BacklogLine{}
+	}
+	backlog := t.backlogs[replica]
+	if len(backlog) < MaxBacklogSize {
+		backlog = append(backlog, line)
 	} else {
-		for i := 1; i < len(t.backlog); i++ {
-			t.backlog[i-1] = t.backlog[i]
+		for i := 1; i < len(backlog); i++ {
+			backlog[i-1] = backlog[i]
 		}
-		t.backlog[MaxBacklogSize-1] = line
+		backlog[MaxBacklogSize-1] = line
 	}
+	t.backlogs[replica] = backlog
 	t.backlogLock.Unlock()
 }
 
-func (t *Task) runOnce(actions <-chan taskAction) {
-	doneChan := make(chan struct{})
-	cmd := t.cmd()
-	t.generateStreams(cmd, doneChan)
+func (t *Task) replicaCount() int {
+	if t.Replicas < 1 {
+		return 1
+	}
+	return t.Replicas
+}
+
+// runReplicas runs every replica of the task until they have all exited or the task is stopped.
+func (t *Task) runReplicas(actions <-chan taskAction) {
+	// The pre-start hooks run once for all of the replicas, so that they never race each other.
+	if stopped, err := t.runHooks(0, 0, "pre-start", t.PreStart, actions,
+		true); stopped || err != nil {
+		return
+	}
+
+	count := t.replicaCount()
+	if count == 1 {
+		t.runReplica(0, actions)
+		return
+	}
+
+	replicas := make([]chan taskAction, count)
+	finished := make(chan int, count)
+	for i := range replicas {
+		replicas[i] = make(chan taskAction)
+		go func(i int) {
+			t.runReplica(i, replicas[i])
+			finished <- i
+			// Answer actions until the run is over so that forwarding never blocks.
+			for val := range replicas[i] {
+				if val.action == taskActionStatus {
+					val.resp <- TaskStatusStopped
+				} else if val.action == taskActionSignal {
+					val.resp <- errTaskNotRunning
+				} else {
+					close(val.resp)
+				}
+			}
+		}(i)
+	}
+	defer func() {
+		for _, ch := range replicas {
+			close(ch)
+		}
+	}()
+
+	for running := count; running > 0; {
+		select {
+		case <-finished:
+			running--
+		case val, ok := <-actions:
+			if !ok || val.action == taskActionStop {
+				if ok {
+					stopReplicas(replicas, actions)
+					close(val.resp)
+				} else {
+					stopReplicas(replicas, nil)
+				}
+				return
+			} else if val.action == taskActionStatus {
+				// The task is running if any replica is, or restarting if any replica is.
+				status := TaskStatusStopped
+				for _, resp := range forwardAction(replicas, taskAction{action: taskActionStatus}) {
+					s := resp.(int)
+					if s == TaskStatusRunning || (s == TaskStatusRestarting &&
+						status == TaskStatusStopped) {
+						status = s
+					}
+				}
+				val.resp <- status
+			} else if val.action == taskActionSignal {
+				// The signal succeeds if it reaches any replica.
+				var err error = errTaskNotRunning
+				for _, resp := range forwardAction(replicas, val) {
+					if resp == nil {
+						err = nil
+					} else if err != nil {
+						err = resp.(error)
+					}
+				}
+				val.resp <- err
+			} else {
+				forwardAction(replicas, val)
+				close(val.resp)
+			}
+		}
+	}
+}
+
+// runReplica runs one replica of the task until it exits or it is stopped.
+func (t *Task) runReplica(replica int, actions <-chan taskAction) {
+	if t.Relaunch {
+		t.runRestart(replica, actions)
+	} else {
+		t.runOnce(replica, actions)
+	}
+}
+
+// stopReplicas stops the loop of every replica. While the replicas stop, other actions are
+// answered as though the task were still running, and further stop actions are answered once
+// they have stopped. Actions may be nil.
+func stopReplicas(replicas []chan taskAction, actions <-chan taskAction) {
+	stopped := make(chan struct{})
+	go func() {
+		forwardAction(replicas, taskAction{action: taskActionStop})
+		close(stopped)
+	}()
+	var stops []chan<- interface{}
+	for {
+		select {
+		case <-stopped:
+			for _, resp := range stops {
+				close(resp)
+			}
+			return
+		case val, ok := <-actions:
+			if !ok {
+				actions = nil
+			} else if val.action == taskActionStop {
+				stops = append(stops, val.resp)
+			} else if val.action == taskActionStatus {
+				val.resp <- TaskStatusRunning
+			} else if val.action == taskActionSignal {
+				var err error = errTaskNotRunning
+				for _, resp := range forwardAction(replicas, val) {
+					if resp == nil {
+						err = nil
+					}
+				}
+				val.resp <- err
+			} else {
+				close(val.resp)
+			}
+		}
+	}
+}
 
-	if err := cmd.Start(); err != nil {
-		t.pushBacklog(BacklogLineStatus, "Error starting task: "+err.Error()+".")
+// forwardAction sends a copy of an action to the loop of every replica at once and returns their
+// responses.
+func forwardAction(replicas []chan taskAction, action taskAction) []interface{} {
+	res := make([]interface{}, len(replicas))
+	var wg sync.WaitGroup
+	for i, ch := range replicas {
+		wg.Add(1)
+		go func(i int, ch chan<- taskAction) {
+			defer wg.Done()
+			resp := make(chan interface{})
+			replicaAction := action
+			replicaAction.resp = resp
+			ch <- replicaAction
+			res[i] = <-resp
+		}(i, ch)
+	}
+	wg.Wait()
+	return res
+}
+
+func (t *Task) runOnce(replica int, actions <-chan taskAction) {
+	port, ok := t.proxyPort(replica)
+	if !ok {
+		return
+	}
+	cmd, err := t.cmd(replica, port)
+	if err != nil {
+		t.pushReplicaBacklog(replica, BacklogLineStatus, "Error starting task: "+err.Error()+".")
+		return
+	}
+	doneChan := make(chan struct{})
+	err = t.generateStreams(replica, cmd, doneChan)
+	if err == nil {
+		err = t.startCommand(replica, cmd)
+	}
+	if err != nil {
+		close(doneChan)
+		t.pushReplicaBacklog(replica, BacklogLineStatus, "Error starting task: "+err.Error()+".")
 		return
 	}
 
-	t.pushBacklog(BacklogLineStatus, "Started task.")
+	t.pushReplicaBacklog(replica, BacklogLineStatus, "Started task.")
+	t.setProcessGroup(replica, cmd.Process.Pid)
+	stopWatching := t.watchTarget(replica, port)
+	stopPostStart := t.startHooks(replica, port, "post-start", t.PostStart)
 
 	go func() {
 		cmd.Wait()
+		t.setProcessGroup(replica, 0)
 		close(doneChan)
 	}()
 
 	for {
 		select {
 		case <-doneChan:
-			t.pushBacklog(BacklogLineStatus, "Task exited.")
+			stopWatching()
+			stopPostStart()
+			t.pushReplicaBacklog(replica, BacklogLineStatus, "Task exited.")
+			t.runHooks(replica, port, "post-stop", t.PostStop, actions, false)
 			return
 		case val, ok := <-actions:
 			if !ok || val.action == taskActionStop {
-				t.pushBacklog(BacklogLineStatus, "Task stopped.")
-				t.terminateCommand(cmd, doneChan)
+				t.pushReplicaBacklog(replica, BacklogLineStatus, "Task stopped.")
+				stopWatching()
+				stopPostStart()
 				if ok {
+					t.terminateCommand(replica, port, cmd, doneChan, actions)
+					t.runHooks(replica, port, "post-stop", t.PostStop, actions, false)
 					close(val.resp)
+				} else {
+					t.terminateCommand(replica, port, cmd, doneChan, nil)
+					t.runHooks(replica, port, "post-stop", t.PostStop, nil, false)
 				}
 				return
 			} else if val.action == taskActionStatus {
 				val.resp <- TaskStatusRunning
+			} else if val.action == taskActionSignal {
+				t.sendSignal(replica, cmd, val)
 			} else {
 				close(val.resp)
 			}
@@ -261,54 +679,106 @@ func (t *Task) runOnce(actions <-chan taskAction) {
 	}
 }
 
-func (t *Task) runRestart(actions <-chan taskAction) {
+func (t *Task) runRestart(replica int, actions <-chan taskAction) {
+	port, ok := t.proxyPort(replica)
+	if !ok {
+		return
+	}
+	cmd, err := t.cmd(replica, port)
+	if err != nil {
+		t.pushReplicaBacklog(replica, BacklogLineStatus, "Error starting: "+err.Error())
+		return
+	}
 	doneChan := make(chan struct{})
-	cmd := t.cmd()
-	t.generateStreams(cmd, doneChan)
-
-	if err := cmd.Start(); err != nil {
-		t.pushBacklog(BacklogLineStatus, "Error starting: "+err.Error())
+	err = t.generateStreams(replica, cmd, doneChan)
+	if err == nil {
+		err = t.startCommand(replica, cmd)
+	}
+	if err != nil {
+		close(doneChan)
+		t.pushReplicaBacklog(replica, BacklogLineStatus, "Error starting: "+err.Error())
 		return
 	}
 
-	t.pushBacklog(BacklogLineStatus, "Started task.")
+	t.pushReplicaBacklog(replica, BacklogLineStatus, "Started task.")
+	t.setProcessGroup(replica, cmd.Process.Pid)
+	stopWatching := t.watchTarget(replica, port)
+	stopPostStart := t.startHooks(replica, port, "post-start", t.PostStart)
 
 	go func() {
 		cmd.Wait()
+		t.setProcessGroup(replica, 0)
 		close(doneChan)
 	}()
 
+	// running is set while a command started by the loop has not been through its post-stop
+	// hooks.
+	running := true
 	for {
 		select {
 		case <-doneChan:
-			if !t.waitTimeout(actions) {
+			stopWatching()
+			stopWatching = func() {}
+			stopPostStart()
+			stopPostStart = func() {}
+			if running {
+				running = false
+				if stopped, _ := t.runHooks(replica, port, "post-stop", t.PostStop, actions,
+					false); stopped {
+					return
+				}
+			}
+			if !t.waitTimeout(replica, actions) {
 				return
 			}
-			cmd = t.cmd()
 			doneChan = make(chan struct{})
-			t.generateStreams(cmd, doneChan)
-			if err := cmd.Start(); err != nil {
-				t.pushBacklog(BacklogLineStatus, "Error restarting: "+err.Error()+".")
+			next, err := t.cmd(replica, port)
+			if err == nil {
+				cmd = next
+				err = t.generateStreams(replica, cmd, doneChan)
+			}
+			if err == nil {
+				err = t.startCommand(replica, cmd)
+			}
+			if err != nil {
+				t.pushReplicaBacklog(replica, BacklogLineStatus, "Error restarting: "+err.Error()+".")
 				close(doneChan)
 			} else {
-				t.pushBacklog(BacklogLineStatus, "Restarted task.")
+				t.pushReplicaBacklog(replica, BacklogLineStatus, "Restarted task.")
+				t.setProcessGroup(replica, cmd.Process.Pid)
+				running = true
+				stopWatching = t.watchTarget(replica, port)
+				stopPostStart = t.startHooks(replica, port, "post-start", t.PostStart)
 				go func() {
 					if err := cmd.Wait(); err != nil {
-						t.pushBacklog(BacklogLineStatus, "Task exited: "+err.Error()+".")
+						t.pushReplicaBacklog(replica, BacklogLineStatus, "Task exited: "+err.Error()+".")
 					}
+					t.setProcessGroup(replica, 0)
 					close(doneChan)
 				}()
 			}
 		case val, ok := <-actions:
 			if !ok || val.action == taskActionStop {
-				t.pushBacklog(BacklogLineStatus, "Task stopped.")
-				t.terminateCommand(cmd, doneChan)
+				t.pushReplicaBacklog(replica, BacklogLineStatus, "Task stopped.")
+				stopWatching()
+				stopPostStart()
+				if ok {
+					t.terminateCommand(replica, port, cmd, doneChan, actions)
+				} else {
+					t.terminateCommand(replica, port, cmd, doneChan, nil)
+					actions = nil
+				}
+				if running {
+					t.runHooks(replica, port, "post-stop", t.PostStop, actions, false)
+				}
 				if ok {
 					close(val.resp)
 				}
 				return
 			} else if val.action == taskActionStatus {
 				val.resp <- TaskStatusRunning
+			} else if val.action == taskActionSignal {
+				t.sendSignal(replica, cmd, val)
 			} else {
 				close(val.resp)
 			}
@@ -316,30 +786,8 @@ func (t *Task) runRestart(actions <-chan taskAction) {
 	}
 }
 
-func (t *Task) terminateCommand(cmd *exec.Cmd, killChan <-chan struct{}) {
-	if pgid, err := syscall.Getpgid(cmd.Process.Pid); err == nil {
-	    syscall.Kill(-pgid, syscall.SIGTERM)
-		select {
-		case <-killChan:
-			return
-		case <-time.After(time.Second):
-		}
-
-		t.pushBacklog(BacklogLineStatus, "Process group did not respond to SIGTERM.")
-
-		syscall.Kill(-pgid, syscall.SIGKILL)
-		select {
-		case <-killChan:
-			return
-		case <-time.After(time.Second):
-		}
-	}
-	t.pushBacklog(BacklogLineStatus, "Process group could not be terminated.")
-	cmd.Process.Kill()
-}
-
-func (t *Task) waitTimeout(actions <-chan taskAction) bool {
-	t.pushBacklog(BacklogLineStatus, "Waiting to restart.")
+func (t *Task) waitTimeout(replica int, actions <-chan taskAction) bool {
+	t.pushReplicaBacklog(replica, BacklogLineStatus, "Waiting to restart.")
 	timeoutChannel := time.After(time.Second * time.Duration(t.Interval))
 	for {
 		select {
@@ -347,7 +795,7 @@ func (t *Task) waitTimeout(actions <-chan taskAction) bool {
 			return true
 		case val, ok := <-actions:
 			if !ok || val.action == taskActionStop {
-				t.pushBacklog(BacklogLineStatus, "Stopped during wait.")
+				t.pushReplicaBacklog(replica, BacklogLineStatus, "Stopped during wait.")
 				if ok {
 					close(val.resp)
 				}
@@ -355,9 +803,11 @@ func (t *Task) waitTimeout(actions <-chan taskAction) bool {
 			} else if val.action == taskActionStatus {
 				val.resp <- TaskStatusRestarting
 			} else if val.action == taskActionStart {
-				t.pushBacklog(BacklogLineStatus, "Wait bypassed.")
+				t.pushReplicaBacklog(replica, BacklogLineStatus, "Wait bypassed.")
 				close(val.resp)
 				return true
+			} else if val.action == taskActionSignal {
+				val.resp <- errTaskNotRunning
 			}
 		}
 	}
@@ -366,6 +816,9 @@ func (t *Task) waitTimeout(actions <-chan taskAction) bool {
 type taskAction struct {
 	action int
 	resp   chan<- interface{}
+
+	// signal is the signal to send for taskActionSignal.
+	signal syscall.Signal
 }
 
 // A lineForwarder is an io.Writer which buffers lines and sends them over a channel.
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TaskTargets holds the proxy targets which running tasks provide.
+var TaskTargets = newTargetRegistry()
+
+// A TaskProxy links a task to a proxy host.
+// The task is given a free local port in its PORT environment variable, and the proxy forwards
+// the host's requests to that port while the task is running and passing its health check.
+type TaskProxy struct {
+	// Host is the key of the host's rule in the rule table. The task's target is added to the
+	// rule's own targets. If there is no such rule, requests for the host go only to the task.
+	Host string
+
+	// HealthCheck decides when the task is ready for requests. If it is nil, the task is ready
+	// once its port accepts TCP connections, which is checked every second.
+	HealthCheck *HealthCheck
+
+	// Deploy selects how a running task is updated when it is edited. It is DeployRestart or
+	// DeployBlueGreen. The empty string is equivalent to DeployRestart.
+	Deploy string
+
+	// DeployTimeout is the number of seconds a new version has to pass its health check before
+	// a blue-green deploy is rolled back. If it is 0, defaultDeployTimeout is used.
+	DeployTimeout int
+
+	// DrainTime is the number of seconds the old version keeps running after the proxy switches
+	// to the new version, so that requests in flight can finish. If it is 0, defaultDrainTime is
+	// used.
+	DrainTime int
+}
+
+// Validate returns an error if the TaskProxy is invalid.
+func (t *TaskProxy) Validate() error {
+	if t.Host == "" {
+		return errors.New("missing proxy host")
+	}
+	if _, _, err := parseHostPattern(t.Host); err != nil {
+		return err
+	}
+	switch t.Deploy {
+	case "", DeployRestart, DeployBlueGreen:
+	default:
+		return errors.New("invalid deploy mode: " + t.Deploy)
+	}
+	if t.DeployTimeout < 0 || t.DrainTime < 0 {
+		return errors.New("deploy times must not be negative")
+	}
+	if t.HealthCheck != nil {
+		return t.HealthCheck.Validate()
+	}
+	return nil
+}
+
+// A targetRegistry tracks the targets which tasks provide for each host.
+type targetRegistry struct {
+	lock sync.Mutex
+
+	// hosts maps each host to its targets, keyed by the instance which provides them.
+	hosts map[string]map[string]*Target
+
+	watcher func(host string, targets []*Target)
+}
+
+func newTargetRegistry() *targetRegistry {
+	return &targetRegistry{hosts: map[string]map[string]*Target{}}
+}
+
+// Add registers the target for an instance of a task.
+func (r *targetRegistry) Add(host, instance string, target *Target) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.hosts[host] == nil {
+		r.hosts[host] = map[string]*Target{}
+	}
+	r.hosts[host][instance] = target
+	r.notify(host)
+}
+
+// Remove unregisters the target for an instance of a task if its address is still the one
+// registered. A new version of the instance may have replaced it during a deploy.
+func (r *targetRegistry) Remove(host, instance, address string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if target, ok := r.hosts[host][instance]; !ok || target.Host != address {
+		return
+	}
+	delete(r.hosts[host], instance)
+	if len(r.hosts[host]) == 0 {
+		delete(r.hosts, host)
+	}
+	r.notify(host)
+}
+
+// Watch calls a function with the current targets of every host, and then again for a host
+// each time its targets change.
+func (r *targetRegistry) Watch(f func(host string, targets []*Target)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.watcher = f
+	for host := range r.hosts {
+		r.notify(host)
+	}
+}
+
+func (r *targetRegistry) notify(host string) {
+	if r.watcher == nil {
+		return
+	}
+	instances := make([]string, 0, len(r.hosts[host]))
+	for instance := range r.hosts[host] {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+	targets := make([]*Target, len(instances))
+	for i, instance := range instances {
+		t := *r.hosts[host][instance]
+		targets[i] = &t
+	}
+	r.watcher(host, targets)
+}
+
+// allocatePort finds a free local TCP port.
+func allocatePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// proxyPort allocates a port for a replica of a task which is linked to a proxy host, or returns
+// 0 if the task is not linked to one. If no port is available, it logs the error and returns
+// false.
+func (t *Task) proxyPort(replica int) (int, bool) {
+	if t.Proxy == nil {
+		return 0, true
+	}
+	port, err := allocatePort()
+	if err != nil {
+		t.pushReplicaBacklog(replica, BacklogLineStatus,
+			"Error allocating port: "+err.Error()+".")
+		return 0, false
+	}
+	return port, true
+}
+
+// watchTarget health checks a replica's process on its port, registering it with TaskTargets
+// while it is healthy. It returns a function which stops the checks and unregisters the target.
+// If the port is 0, the task is not linked to a host and nothing is checked.
+func (t *Task) watchTarget(replica, port int) func() {
+	if port == 0 {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t.monitorTarget(replica, port, stop)
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func (t *Task) monitorTarget(replica, port int, stop <-chan struct{}) {
+	check := HealthCheck{Type: "tcp", Interval: 1, Rise: 1}
+	if t.Proxy.HealthCheck != nil {
+		check = *t.Proxy.HealthCheck
+	}
+	check = check.withDefaults()
+	host := t.Proxy.Host
+	instance := t.proxyInstance(replica)
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	var up bool
+	var successes, failures int
+	defer func() {
+		if up {
+			t.setProxyAddress(replica, "")
+			TaskTargets.Remove(host, instance, address)
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second * time.Duration(check.Interval))
+	defer ticker.Stop()
+	for {
+		if err := probeTarget(check, address); err != nil {
+			successes = 0
+			failures++
+			if up && failures >= check.Fall {
+				up = false
+				t.setProxyAddress(replica, "")
+				TaskTargets.Remove(host, instance, address)
+				t.pushReplicaBacklog(replica, BacklogLineStatus,
+					"Removed from proxy: "+err.Error()+".")
+			}
+		} else {
+			failures = 0
+			successes++
+			if !up && successes >= check.Rise {
+				up = true
+				if t.setProxyAddress(replica, address) {
+					TaskTargets.Add(host, instance, &Target{Host: address})
+				}
+				t.pushReplicaBacklog(replica, BacklogLineStatus,
+					"Added to proxy on port "+strconv.Itoa(port)+".")
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// proxyInstance returns the key under which a replica's target is registered with TaskTargets.
+// Every version of a task uses the same keys, so registering a new version replaces the old one.
+func (t *Task) proxyInstance(replica int) string {
+	return "task/" + strconv.FormatInt(t.ID, 10) + "/" + strconv.Itoa(replica)
+}
+
+// setProxyAddress records the address at which a replica is healthy, or "" if it is not.
+// It returns false if the address should not be registered because the task is being replaced.
+func (t *Task) setProxyAddress(replica int, address string) bool {
+	t.proxyLock.Lock()
+	defer t.proxyLock.Unlock()
+	if t.proxyAddresses == nil {
+		t.proxyAddresses = map[int]string{}
+	}
+	if address == "" {
+		delete(t.proxyAddresses, replica)
+	} else {
+		t.proxyAddresses[replica] = address
+	}
+	return !t.proxyRetired
+}
+
+// isHealthy returns whether every replica of the task is passing its health check.
+func (t *Task) isHealthy() bool {
+	t.proxyLock.Lock()
+	defer t.proxyLock.Unlock()
+	return len(t.proxyAddresses) == t.replicaCount()
+}
+
+// setProxyRetired stops or resumes the registration of the task's targets.
+// When the task is retired, the targets of its replicas which a new version has not replaced,
+// such as replicas beyond the new version's count, are unregistered. When the task is resumed,
+// the targets of its healthy replicas are registered again.
+func (t *Task) setProxyRetired(retired bool) {
+	t.proxyLock.Lock()
+	defer t.proxyLock.Unlock()
+	t.proxyRetired = retired
+	for replica, address := range t.proxyAddresses {
+		if retired {
+			TaskTargets.Remove(t.Proxy.Host, t.proxyInstance(replica), address)
+		} else {
+			TaskTargets.Add(t.Proxy.Host, t.proxyInstance(replica), &Target{Host: address})
+		}
+	}
+}
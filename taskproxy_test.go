@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetProxyRetired(t *testing.T) {
+	var registered []string
+	registry := TaskTargets
+	TaskTargets = newTargetRegistry()
+	defer func() {
+		TaskTargets = registry
+	}()
+	TaskTargets.Watch(func(host string, targets []*Target) {
+		registered = nil
+		for _, target := range targets {
+			registered = append(registered, target.Host)
+		}
+	})
+
+	// The old version has three replicas and the new version has two.
+	old := &Task{ID: 1, Replicas: 3, Proxy: &TaskProxy{Host: "example.com"}}
+	next := &Task{ID: 1, Replicas: 2, Proxy: &TaskProxy{Host: "example.com"}}
+	for replica, address := range []string{"127.0.0.1:1000", "127.0.0.1:1001",
+		"127.0.0.1:1002"} {
+		old.setProxyAddress(replica, address)
+		TaskTargets.Add("example.com", old.proxyInstance(replica), &Target{Host: address})
+	}
+	for replica, address := range []string{"127.0.0.1:2000", "127.0.0.1:2001"} {
+		next.setProxyAddress(replica, address)
+		TaskTargets.Add("example.com", next.proxyInstance(replica), &Target{Host: address})
+	}
+
+	old.setProxyRetired(true)
+	expected := []string{"127.0.0.1:2000", "127.0.0.1:2001"}
+	if !reflect.DeepEqual(registered, expected) {
+		t.Errorf("expected %v but got %v", expected, registered)
+	}
+
+	// Rolling back registers every replica of the old version again.
+	next.setProxyRetired(true)
+	old.setProxyRetired(false)
+	expected = []string{"127.0.0.1:1000", "127.0.0.1:1001", "127.0.0.1:1002"}
+	if !reflect.DeepEqual(registered, expected) {
+		t.Errorf("expected %v but got %v", expected, registered)
+	}
+}
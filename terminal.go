@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	defaultTerminalRows    = 24
+	defaultTerminalColumns = 80
+)
+
+// terminalScrollback is the number of bytes of recent terminal output which a console is sent
+// when it connects.
+const terminalScrollback = 64 << 10
+
+// consoleBuffer is the number of output chunks which may be queued for a console. A console
+// which falls further behind is disconnected so that it cannot stall the task.
+const consoleBuffer = 256
+
+// A Terminal runs a task's processes under a pseudo-terminal instead of pipes, so that they can
+// be used interactively from the console page.
+type Terminal struct {
+	// Rows and Columns are the size of the terminal. If one is 0, a default is used.
+	Rows    int
+	Columns int
+}
+
+// Validate returns an error if the Terminal is invalid.
+func (t *Terminal) Validate() error {
+	if t.Rows < 0 || t.Rows > 0xffff || t.Columns < 0 || t.Columns > 0xffff {
+		return errors.New("invalid terminal size")
+	}
+	return nil
+}
+
+func (t *Terminal) size() (rows, columns int) {
+	rows, columns = t.Rows, t.Columns
+	if rows == 0 {
+		rows = defaultTerminalRows
+	}
+	if columns == 0 {
+		columns = defaultTerminalColumns
+	}
+	return
+}
+
+// openPTY opens a new pseudo-terminal with the given size.
+func openPTY(rows, columns int) (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var number uint32
+	winsize := [4]uint16{uint16(rows), uint16(columns), 0, 0}
+	err = ptyControl(master, func(fd uintptr) error {
+		var unlock int32
+		if err := ioctl(fd, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+			return err
+		}
+		if err := ioctl(fd, syscall.TIOCSWINSZ, unsafe.Pointer(&winsize)); err != nil {
+			return err
+		}
+		return ioctl(fd, syscall.TIOCGPTN, unsafe.Pointer(&number))
+	})
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slavePath := "/dev/pts/" + strconv.Itoa(int(number))
+	slave, err = os.OpenFile(slavePath, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// ptyControl runs f with the descriptor of a file without putting it in blocking mode, so that
+// closing the file still interrupts reads.
+func ptyControl(f *os.File, control func(fd uintptr) error) error {
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var controlErr error
+	if err := raw.Control(func(fd uintptr) { controlErr = control(fd) }); err != nil {
+		return err
+	}
+	return controlErr
+}
+
+func ioctl(fd, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// A terminalState is the pseudo-terminal of a task replica and the consoles watching it.
+// It outlives each run of the replica, so that consoles stay connected across restarts.
+type terminalState struct {
+	lock       sync.Mutex
+	master     *os.File
+	scrollback []byte
+	consoles   map[chan []byte]bool
+}
+
+func (s *terminalState) setMaster(master *os.File) {
+	s.lock.Lock()
+	s.master = master
+	s.lock.Unlock()
+}
+
+// broadcast records output in the scrollback and sends it to the consoles.
+func (s *terminalState) broadcast(data []byte) {
+	data = append([]byte{}, data...)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.scrollback = append(s.scrollback, data...)
+	if len(s.scrollback) > terminalScrollback {
+		s.scrollback = append([]byte{}, s.scrollback[len(s.scrollback)-terminalScrollback:]...)
+	}
+	for console := range s.consoles {
+		select {
+		case console <- data:
+		default:
+			close(console)
+			delete(s.consoles, console)
+		}
+	}
+}
+
+func (t *Task) terminalState(replica int) *terminalState {
+	t.terminalLock.Lock()
+	defer t.terminalLock.Unlock()
+	if t.terminals == nil {
+		t.terminals = map[int]*terminalState{}
+	}
+	state := t.terminals[replica]
+	if state == nil {
+		state = &terminalState{consoles: map[chan []byte]bool{}}
+		t.terminals[replica] = state
+	}
+	return state
+}
+
+// generateTerminal connects a replica's command to a new pseudo-terminal. Its output is sent to
+// consoles and recorded in the backlog until doneChan is closed.
+func (t *Task) generateTerminal(replica int, cmd *exec.Cmd, doneChan <-chan struct{}) error {
+	master, slave, err := openPTY(t.Terminal.size())
+	if err != nil {
+		return errors.New("opening terminal: " + err.Error())
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+
+	// The command leads a new session, which is also a process group, so that the terminal
+	// can be its controlling terminal.
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+
+	state := t.terminalState(replica)
+	state.setMaster(master)
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		var line bytes.Buffer
+		buf := make([]byte, 4096)
+		for {
+			n, err := master.Read(buf)
+			if n > 0 {
+				state.broadcast(buf[:n])
+			}
+			for _, ch := range buf[:n] {
+				if ch == '\n' {
+					t.pushReplicaBacklog(replica, BacklogLineStdout,
+						string(bytes.TrimRight(line.Bytes(), "\r")))
+					line.Reset()
+				} else {
+					line.WriteByte(ch)
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		if line.Len() > 0 {
+			t.pushReplicaBacklog(replica, BacklogLineStdout,
+				string(bytes.TrimRight(line.Bytes(), "\r")))
+		}
+	}()
+	go func() {
+		<-doneChan
+		slave.Close()
+
+		// Reads end once every copy of the slave is closed, unless a background process of
+		// the task still has one.
+		select {
+		case <-readDone:
+		case <-time.After(time.Second):
+		}
+		state.setMaster(nil)
+		master.Close()
+	}()
+	return nil
+}
+
+// WriteTerminal sends input to the terminal of a running replica.
+func (t *Task) WriteTerminal(replica int, data []byte) error {
+	state := t.terminalState(replica)
+	state.lock.Lock()
+	master := state.master
+	state.lock.Unlock()
+	if master == nil {
+		return errTaskNotRunning
+	}
+	_, err := master.Write(data)
+	return err
+}
+
+// watchTerminal returns the recent output of a replica's terminal and a channel of its further
+// output. The channel is closed when cancel is called, when the console falls too far behind,
+// or when the task's loop stops.
+func (t *Task) watchTerminal(replica int) (scrollback []byte, output <-chan []byte,
+	cancel func()) {
+	state := t.terminalState(replica)
+	console := make(chan []byte, consoleBuffer)
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.consoles[console] = true
+	cancel = func() {
+		state.lock.Lock()
+		defer state.lock.Unlock()
+		if state.consoles[console] {
+			delete(state.consoles, console)
+			close(console)
+		}
+	}
+	return append([]byte{}, state.scrollback...), console, cancel
+}
+
+// closeConsoles disconnects every console watching the task.
+func (t *Task) closeConsoles() {
+	t.terminalLock.Lock()
+	defer t.terminalLock.Unlock()
+	for _, state := range t.terminals {
+		state.lock.Lock()
+		for console := range state.consoles {
+			close(console)
+		}
+		state.consoles = map[chan []byte]bool{}
+		state.lock.Unlock()
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// passwdPath and groupPath are the databases which user and group names are resolved with.
+const (
+	passwdPath = "/etc/passwd"
+	groupPath  = "/etc/group"
+)
+
+// A userAccount is an entry in the passwd database.
+type userAccount struct {
+	Name string
+	UID  uint32
+	GID  uint32
+	Home string
+}
+
+// lookupUser finds a user by name, or by UID if the name is a number.
+func lookupUser(name string) (*userAccount, error) {
+	var res *userAccount
+	err := scanDatabase(passwdPath, func(fields []string) bool {
+		if len(fields) < 6 || (fields[0] != name && fields[2] != name) {
+			return false
+		}
+		uid, err1 := strconv.ParseUint(fields[2], 10, 32)
+		gid, err2 := strconv.ParseUint(fields[3], 10, 32)
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		res = &userAccount{Name: fields[0], UID: uint32(uid), GID: uint32(gid), Home: fields[5]}
+		return true
+	})
+	if err == nil && res == nil {
+		err = errors.New("unknown user: " + name)
+	}
+	return res, err
+}
+
+// lookupGroup finds the GID of a group by name, or returns the name itself if it is a number.
+func lookupGroup(name string) (uint32, error) {
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+	var res uint32
+	var found bool
+	err := scanDatabase(groupPath, func(fields []string) bool {
+		if len(fields) < 3 || fields[0] != name {
+			return false
+		}
+		gid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return false
+		}
+		res, found = uint32(gid), true
+		return true
+	})
+	if err == nil && !found {
+		err = errors.New("unknown group: " + name)
+	}
+	return res, err
+}
+
+// userGroups returns a user's primary group followed by the groups which list the user as a
+// member.
+func userGroups(name string, primary uint32) ([]uint32, error) {
+	res := []uint32{primary}
+	err := scanDatabase(groupPath, func(fields []string) bool {
+		if len(fields) < 4 {
+			return false
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member != name {
+				continue
+			}
+			gid, err := strconv.ParseUint(fields[2], 10, 32)
+			if err == nil && uint32(gid) != primary {
+				res = append(res, uint32(gid))
+			}
+			break
+		}
+		return false
+	})
+	return res, err
+}
+
+// scanDatabase calls a function with the colon-separated fields of each entry in a passwd or group
+// database until it returns true.
+func scanDatabase(path string, f func(fields []string) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if f(strings.Split(line, ":")) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// validateAccount returns an error if the task's user or group does not exist.
+func (t *Task) validateAccount() error {
+	_, _, err := t.credential()
+	return err
+}
+
+// credential returns the credentials with which the task's commands run, or nil if they run as
+// goule's user. If the task has a user name, it also returns the HOME, USER, and LOGNAME
+// environment variables for the user.
+func (t *Task) credential() (*syscall.Credential, []string, error) {
+	if t.User == "" && t.Group == "" && !t.SetUID && !t.SetGID {
+		return nil, nil, nil
+	}
+	cred := &syscall.Credential{
+		Uid: uint32(syscall.Getuid()),
+		Gid: uint32(syscall.Getgid()),
+	}
+	var env []string
+	if t.User != "" {
+		account, err := lookupUser(t.User)
+		if err != nil {
+			return nil, nil, err
+		}
+		cred.Uid, cred.Gid = account.UID, account.GID
+		cred.Groups, err = userGroups(account.Name, account.GID)
+		if err != nil {
+			return nil, nil, err
+		}
+		env = []string{"HOME=" + account.Home, "USER=" + account.Name,
+			"LOGNAME=" + account.Name}
+	} else if t.SetUID {
+		cred.Uid = uint32(t.UID)
+	}
+	if t.Group != "" {
+		gid, err := lookupGroup(t.Group)
+		if err != nil {
+			return nil, nil, err
+		}
+		cred.Gid = gid
+	} else if t.SetGID {
+		cred.Gid = uint32(t.GID)
+	}
+	return cred, env, nil
+}